@@ -1,10 +1,16 @@
-module zip-sizer
+module github.com/arunsupe/zip-sizer
 
 go 1.22.5
 
 require (
 	github.com/alexflint/go-arg v1.5.1
+	github.com/andybalholm/brotli v1.1.1
 	github.com/dsnet/compress v0.0.1
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.17.11
+	github.com/pierrec/lz4/v4 v4.1.30
+	github.com/sabhiram/go-gitignore v0.0.0-20210923224102-525f6e181f06
+	github.com/ulikunitz/xz v0.5.12
 )
 
 require github.com/alexflint/go-scalar v1.2.0 // indirect
@@ -0,0 +1,112 @@
+package sizer
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Write a real compressed tar archive of the directory to archivePath
+// The same files the estimate walked are streamed from disk through tar and the compressor,
+// so this costs as much as running tar yourself. The archive itself is skipped if it lives
+// inside the directory being archived
+// The function returns the size of the finished archive in bytes
+func createArchive(directory string, filter *fileFilter, errorLog io.Writer, archivePath string, compressionLevel int, compressionAlgorithm string, verbose bool) (int64, error) {
+	archiveAbsPath, err := filepath.Abs(archivePath)
+	if err != nil {
+		return 0, err
+	}
+
+	archiveFile, err := os.Create(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer archiveFile.Close()
+
+	compressionWriter, err := newCompressionWriter(archiveFile, compressionLevel, compressionAlgorithm, nil)
+	if err != nil {
+		return 0, err
+	}
+	tarWriter := tar.NewWriter(compressionWriter)
+
+	// On an early return the walk is stopped, and the channel drained so that it is not left
+	// blocked on a file it had already listed
+	ctx, cancel := context.WithCancel(context.Background())
+	fileInfoChan := make(chan FileInfo)
+	go listFilesWithSizes(ctx, directory, filter, errorLog, fileInfoChan)
+	defer func() {
+		cancel()
+		for range fileInfoChan {
+		}
+	}()
+
+	for file := range fileInfoChan {
+		if absPath, err := filepath.Abs(file.Path); err == nil && absPath == archiveAbsPath {
+			continue
+		}
+		if err := addFileToArchive(tarWriter, directory, file, verbose); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return 0, err
+	}
+	if err := compressionWriter.Close(); err != nil {
+		return 0, err
+	}
+	if err := archiveFile.Close(); err != nil {
+		return 0, err
+	}
+
+	stat, err := os.Stat(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// Write a single file, with its tar header, into the archive
+func addFileToArchive(tarWriter *tar.Writer, directory string, file FileInfo, verbose bool) error {
+	// The walk only lists symlinks when following them, so archive what they point to
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	relativePath, err := filepath.Rel(directory, file.Path)
+	if err != nil {
+		return err
+	}
+	// A single file archived on its own keeps its base name
+	if relativePath == "." {
+		relativePath = filepath.Base(file.Path)
+	}
+	header.Name = filepath.ToSlash(relativePath)
+
+	if verbose {
+		log.Printf("Archiving file: %s", file.Path)
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Copy exactly the size recorded in the header, in case the file grows while we read it
+	_, err = io.CopyN(tarWriter, f, header.Size)
+	return err
+}
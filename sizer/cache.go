@@ -0,0 +1,192 @@
+package sizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The settings an estimate depends on besides the files themselves
+// Any change to them gives a different cache key, so the cache never returns an estimate made
+// with other settings
+type cacheSettings struct {
+	Directories          []string
+	CompressionLevel     int
+	CompressionAlgorithm string
+	SampleRatio          float64
+	SampleSize           int64
+	ChunkSize            int64
+	Sampling             string
+	Sort                 string
+	Workers              int
+	Adaptive             bool
+	AdaptiveRatio        bool
+	Tolerance            float64
+	MaxSample            int64
+	ExcludeRegex         []string
+	Exclude              []string
+	ExcludeFullPath      bool
+	Include              []string
+	MaxDepth             int
+	FollowSymlinks       bool
+	Gitignore            bool
+	MinSize              int64
+	MaxSize              int64
+	Top                  int
+	OpenArchives         bool
+	BlockSize            int64
+	SamplePlan           []SampleWindow
+	Seed                 *int64
+	DeltaFilter          bool
+	AgainstArchive       string
+	EncryptThenCompress  bool
+	Breakdown            bool
+	ByExtension          bool
+	CompressThreshold    int64
+	Tar                  bool
+	SkipCompressed       bool
+	CompressedExtensions []string
+	SizeIndex            string
+	FilesFrom            string
+	Hints                map[string]float64
+	Dictionary           []byte
+}
+
+// Check whether an estimate with these options can be cached
+// Creating an archive and dumping or learning from the samples have to happen on every run,
+// and a file list read from stdin cannot be listed a second time to check it
+func (opts Options) cacheable() bool {
+	return opts.CacheDir != "" && opts.Create == "" && opts.DumpSample == nil && opts.Learned == nil && opts.FilesFrom != "-"
+}
+
+// Work out the cache key of an estimate of the directories: a hash of the settings and of the
+// path, size and modification time of every listed file
+// Listing the files is far cheaper than sampling them, and any file that is added, removed or
+// changed gives a different key
+func cacheKey(ctx context.Context, directories []string, opts Options) (string, error) {
+	settings := cacheSettings{
+		Directories:          directories,
+		CompressionLevel:     opts.CompressionLevel,
+		CompressionAlgorithm: opts.CompressionAlgorithm,
+		SampleRatio:          opts.SampleRatio,
+		SampleSize:           opts.SampleSize,
+		ChunkSize:            opts.ChunkSize,
+		Sampling:             opts.Sampling,
+		Sort:                 opts.Sort,
+		Workers:              opts.Workers,
+		Adaptive:             opts.Adaptive,
+		AdaptiveRatio:        opts.AdaptiveRatio,
+		Tolerance:            opts.Tolerance,
+		MaxSample:            opts.MaxSample,
+		Exclude:              opts.Exclude,
+		ExcludeFullPath:      opts.ExcludeFullPath,
+		Include:              opts.Include,
+		MaxDepth:             opts.MaxDepth,
+		FollowSymlinks:       opts.FollowSymlinks,
+		Gitignore:            opts.Gitignore,
+		MinSize:              opts.MinSize,
+		MaxSize:              opts.MaxSize,
+		Top:                  opts.Top,
+		OpenArchives:         opts.OpenArchives,
+		BlockSize:            opts.BlockSize,
+		SamplePlan:           opts.SamplePlan,
+		Seed:                 opts.Seed,
+		DeltaFilter:          opts.DeltaFilter,
+		AgainstArchive:       opts.AgainstArchive,
+		EncryptThenCompress:  opts.EncryptThenCompress,
+		Breakdown:            opts.Breakdown,
+		ByExtension:          opts.ByExtension,
+		CompressThreshold:    opts.CompressThreshold,
+		Tar:                  opts.Tar,
+		SkipCompressed:       opts.SkipCompressed,
+		CompressedExtensions: opts.CompressedExtensions,
+		SizeIndex:            opts.SizeIndex,
+		FilesFrom:            opts.FilesFrom,
+		Hints:                opts.Hints,
+		Dictionary:           opts.Dictionary,
+	}
+	for _, re := range opts.ExcludeRegex {
+		settings.ExcludeRegex = append(settings.ExcludeRegex, re.String())
+	}
+	encodedSettings, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write(encodedSettings)
+
+	// The archive priming the compressor counts as one of the files
+	if opts.AgainstArchive != "" {
+		if info, err := os.Stat(opts.AgainstArchive); err == nil {
+			fmt.Fprintf(hash, "%s\x00%d\x00%d\n", opts.AgainstArchive, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+
+	// The files stored in an archive change with the archive
+	if opts.OpenArchives {
+		for _, directory := range directories {
+			if info, err := os.Stat(directory); err == nil && info.Mode().IsRegular() && isArchive(directory) {
+				fmt.Fprintf(hash, "%s\x00%d\x00%d\n", directory, info.Size(), info.ModTime().UnixNano())
+			}
+		}
+	}
+
+	// List the files without reporting progress or errors, which the estimate itself does
+	listing := opts
+	listing.Progress = nil
+	listing.Errors = nil
+	for file := range listFiles(ctx, directories, listing) {
+		modTime := int64(0)
+		if info, err := os.Stat(file.Path); err == nil {
+			modTime = info.ModTime().UnixNano()
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\n", file.Path, file.Size, modTime)
+	}
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Read the estimate stored under a cache key, reporting whether there was one
+func readCachedResult(cacheDir, key string) (Result, bool) {
+	data, err := os.ReadFile(filepath.Join(cacheDir, key+".json"))
+	if err != nil {
+		return Result{}, false
+	}
+	var result Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return Result{}, false
+	}
+	return result, true
+}
+
+// Store an estimate under a cache key, creating the cache directory if need be
+// The estimate is written to a temporary file first, so that an interrupted write never
+// leaves a truncated entry behind
+func writeCachedResult(cacheDir, key string, result Result) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(cacheDir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), filepath.Join(cacheDir, key+".json"))
+}
@@ -0,0 +1,187 @@
+package sizer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// Options fields that are left out of the cache key, as they do not change the estimate or
+// make it uncacheable
+var uncachedOptions = map[string]bool{
+	"Verbose":         true,
+	"Progress":        true,
+	"Errors":          true,
+	"DumpSample":      true, // Not cacheable
+	"MaxSampleMemory": true, // Only decides where the samples are held
+	"ReadRetries":     true,
+	"OnFile":          true,
+	"ConcurrentWalk":  true, // Lists the same files
+	"Create":          true, // Not cacheable
+	"CacheDir":        true,
+	"Learned":         true, // Not cacheable
+	"UseLearned":      true, // Only used with Learned
+}
+
+// Change a value to a different one of the same type
+func changeValue(t *testing.T, name string, value reflect.Value) {
+	t.Helper()
+	switch value.Kind() {
+	case reflect.Bool:
+		value.SetBool(!value.Bool())
+	case reflect.Int, reflect.Int64:
+		value.SetInt(value.Int() + 1)
+	case reflect.Float64:
+		value.SetFloat(value.Float() + 0.5)
+	case reflect.String:
+		value.SetString(value.String() + "x")
+	case reflect.Slice:
+		element := reflect.New(value.Type().Elem()).Elem()
+		switch element.Kind() {
+		case reflect.String:
+			element.SetString("x")
+		case reflect.Uint8:
+			element.SetUint('x')
+		case reflect.Struct:
+			element.Field(0).SetInt(1)
+		default:
+			t.Fatalf("no change for the elements of %s", name)
+		}
+		value.Set(reflect.Append(value, element))
+	case reflect.Map:
+		if value.IsNil() {
+			value.Set(reflect.MakeMap(value.Type()))
+		}
+		value.SetMapIndex(reflect.ValueOf("x"), reflect.ValueOf(0.5))
+	case reflect.Pointer:
+		if value.IsNil() {
+			value.Set(reflect.New(value.Type().Elem()))
+		} else {
+			value.Set(reflect.Zero(value.Type()))
+		}
+	default:
+		t.Fatalf("no change for %s of kind %s", name, value.Kind())
+	}
+}
+
+func mustCacheKey(t *testing.T, directories []string, opts Options) string {
+	t.Helper()
+	key, err := cacheKey(context.Background(), directories, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCacheKeyCoversEveryOption(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, "some data", "more data")
+	directories := []string{dir}
+	base := DefaultOptions()
+	baseKey := mustCacheKey(t, directories, base)
+	if key := mustCacheKey(t, directories, base); key != baseKey {
+		t.Fatalf("the same settings gave keys %s and %s", baseKey, key)
+	}
+
+	cached := make(map[string]bool)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(cacheSettings{})) {
+		cached[field.Name] = true
+	}
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(Options{})) {
+		if uncachedOptions[field.Name] {
+			if cached[field.Name] {
+				t.Errorf("%s is in the cache key but listed as left out", field.Name)
+			}
+			continue
+		}
+		if !cached[field.Name] {
+			t.Errorf("%s is not in the cache key", field.Name)
+			continue
+		}
+		t.Run(field.Name, func(t *testing.T) {
+			opts := base
+			if field.Name == "ExcludeRegex" {
+				opts.ExcludeRegex = []*regexp.Regexp{regexp.MustCompile("x")}
+			} else {
+				changeValue(t, field.Name, reflect.ValueOf(&opts).Elem().FieldByIndex(field.Index))
+			}
+			if key := mustCacheKey(t, directories, opts); key == baseKey {
+				t.Errorf("changing %s left the key unchanged", field.Name)
+			}
+		})
+	}
+
+	if key := mustCacheKey(t, []string{dir, dir}, base); key == baseKey {
+		t.Error("changing the directories left the key unchanged")
+	}
+}
+
+func TestCacheKeyChangesWithFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := writeFiles(t, dir, "some data", "more data")
+	directories := []string{dir}
+	opts := DefaultOptions()
+	key := mustCacheKey(t, directories, opts)
+
+	// A file touched without changing its size or contents
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(files[0].Path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	touchedKey := mustCacheKey(t, directories, opts)
+	if touchedKey == key {
+		t.Error("touching a file left the key unchanged")
+	}
+
+	// A file grown, and one added
+	if err := os.WriteFile(files[1].Path, []byte("more data, and then some"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	grownKey := mustCacheKey(t, directories, opts)
+	if grownKey == touchedKey {
+		t.Error("growing a file left the key unchanged")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "new"), []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if mustCacheKey(t, directories, opts) == grownKey {
+		t.Error("adding a file left the key unchanged")
+	}
+}
+
+func TestCachedResults(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	if _, ok := readCachedResult(cacheDir, "key"); ok {
+		t.Error("found an entry in a cache that does not exist")
+	}
+
+	result := Result{TotalSize: 1000, Files: 3, EstimatedCompressedSize: 400, Ratio: 0.4}
+	if err := writeCachedResult(cacheDir, "key", result); err != nil {
+		t.Fatal(err)
+	}
+	if cached, ok := readCachedResult(cacheDir, "key"); !ok || !reflect.DeepEqual(cached, result) {
+		t.Errorf("read back %+v, %v, want %+v", cached, ok, result)
+	}
+	if _, ok := readCachedResult(cacheDir, "other"); ok {
+		t.Error("found an entry under a key that was never stored")
+	}
+
+	// An entry cut short, as by a full disk, is a miss rather than a zero estimate
+	path := filepath.Join(cacheDir, "key.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range []int{0, 1, len(data) / 2, len(data) - 1} {
+		if err := os.WriteFile(path, data[:length], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if cached, ok := readCachedResult(cacheDir, "key"); ok {
+			t.Errorf("an entry truncated to %d bytes was read as %+v", length, cached)
+		}
+	}
+}
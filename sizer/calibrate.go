@@ -0,0 +1,93 @@
+package sizer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Generate calibration data of known compressibility
+// Random bytes do not compress at all, zeros compress almost completely, and lorem ipsum
+// text compresses like ordinary prose. The generator is seeded so every run sees the same data
+func generateCalibrationData(kind string, size int) []byte {
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 0, size)
+	switch kind {
+	case "random":
+		data = data[:size]
+		random.Read(data)
+	case "zeros":
+		data = data[:size]
+	case "text":
+		words := strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor " +
+			"incididunt ut labore et dolore magna aliqua enim ad minim veniam quis nostrud exercitation " +
+			"ullamco laboris nisi aliquip ex ea commodo consequat duis aute irure in reprehenderit voluptate")
+		for len(data) < size {
+			data = append(data, words[random.Intn(len(words))]...)
+			data = append(data, ' ')
+		}
+		data = data[:size]
+	}
+	return data
+}
+
+// Run the full sampling and compression pipeline on generated data for every algorithm that
+// supports the level, and
+// check that the estimated ratios match those of compressing the whole data
+// Estimates within 5% (or 0.01 for highly compressible data) of the real ratio pass
+// The function returns whether every check passed
+func Calibrate(compressionLevel int, verbose bool) (bool, error) {
+	tempDir, err := os.MkdirTemp("", "zip-sizer-calibrate-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	sampleSize := int64(CALIBRATION_CHUNK_SIZE / 10)
+	passed := true
+	for _, kind := range []string{"random", "zeros", "text"} {
+		data := generateCalibrationData(kind, CALIBRATION_SIZE)
+		dataDir := filepath.Join(tempDir, kind)
+		if err := os.Mkdir(dataDir, 0o755); err != nil {
+			return false, err
+		}
+		if err := os.WriteFile(filepath.Join(dataDir, kind+".dat"), data, 0o644); err != nil {
+			return false, err
+		}
+
+		for _, algorithm := range CompressionAlgorithms {
+			if compressionLevel < MinCompressionLevel(algorithm) || compressionLevel > MaxCompressionLevel(algorithm) {
+				continue
+			}
+			compressedSize, err := compressedLength(data, compressionLevel, algorithm, nil)
+			if err != nil {
+				return false, err
+			}
+			expectedRatio := float64(compressedSize) / float64(len(data))
+
+			fileInfoChan := make(chan FileInfo)
+			go listFilesWithSizes(context.Background(), dataDir, nil, os.Stderr, fileInfoChan)
+			sampledData, err := streamSampledData(context.Background(), fileInfoChan, CALIBRATION_CHUNK_SIZE, sampleSize, nil, nil, nil, 0, os.Stderr, verbose)
+			if err != nil {
+				return false, err
+			}
+			estimatedRatio, err := compressData(sampledData, compressionLevel, algorithm, nil, nil)
+			sampledData.Close()
+			if err != nil {
+				return false, err
+			}
+
+			status := "ok"
+			if math.Abs(estimatedRatio-expectedRatio) > max(0.05*expectedRatio, 0.01) {
+				status = "FAILED"
+				passed = false
+			}
+			fmt.Printf("%-6s %-6s level %d: expected ratio %.4f, estimated %.4f ... %s\n", algorithm, kind, compressionLevel, expectedRatio, estimatedRatio, status)
+		}
+	}
+	return passed, nil
+}
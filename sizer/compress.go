@@ -0,0 +1,723 @@
+package sizer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Supported compression algorithms
+var CompressionAlgorithms = []string{"gzip", "bzip2", "zstd", "xz", "brotli", "lz4", "snappy"}
+
+// Extensions of files whose contents are already compressed: archives, compressed images,
+// audio and video, and the zip-based document formats. Compressing them again gains next to nothing
+var CompressedExtensions = []string{
+	".gz", ".tgz", ".bz2", ".tbz2", ".xz", ".txz", ".zst", ".lz4", ".br", ".7z", ".zip", ".rar",
+	".jar", ".apk", ".docx", ".xlsx", ".pptx", ".odt", ".ods", ".odp", ".epub",
+	".png", ".jpg", ".jpeg", ".gif", ".webp", ".heic", ".avif",
+	".mp3", ".aac", ".m4a", ".ogg", ".opus", ".flac",
+	".mp4", ".m4v", ".mkv", ".webm", ".mov", ".avi",
+	".woff", ".woff2",
+}
+
+// Dictionary size used by the xz command line tool's presets -1 to -9
+func xzDictCap(compressionLevel int) int {
+	switch {
+	case compressionLevel <= 1:
+		return 1 << 20
+	case compressionLevel == 2:
+		return 2 << 20
+	case compressionLevel <= 4:
+		return 4 << 20
+	case compressionLevel <= 6:
+		return 8 << 20
+	case compressionLevel == 7:
+		return 16 << 20
+	case compressionLevel == 8:
+		return 32 << 20
+	default:
+		return 64 << 20
+	}
+}
+
+// brotli quality for a compression level, spreading levels 1-9 evenly over qualities 0-11
+func brotliQuality(compressionLevel int) int {
+	return int(math.Round(float64(compressionLevel-1) * brotli.BestCompression / 8))
+}
+
+// lz4 compression level for a compression level, following the lz4 command line tool: level 1
+// is the fast default compressor and levels 2-9 use the high compression one
+func lz4Level(compressionLevel int) lz4.CompressionLevel {
+	if compressionLevel <= 1 {
+		return lz4.Fast
+	}
+	return lz4.Level1 << (min(compressionLevel, 9) - 1)
+}
+
+// compressionAlgorithm describes one of the CompressionAlgorithms: the levels it accepts and
+// how to compress with it at one of them
+type compressionAlgorithm struct {
+	minLevel     int
+	maxLevel     int
+	defaultLevel int // The level the algorithm's own command line tool uses when given none
+	newWriter    func(w io.Writer, compressionLevel int) (io.WriteCloser, error)
+
+	// Compress with a preset dictionary, for the algorithms that can have one
+	newDictionaryWriter func(w io.Writer, compressionLevel int, dictionary []byte) (io.WriteCloser, error)
+
+	// How far back the compressor finds matches, so how much of the data before some more can
+	// make it compress better; 0 for those that compress every block of their input on its own
+	reach int
+}
+
+// The supported compression algorithms by name; adding one here and to CompressionAlgorithms
+// is all it takes
+// For gzip the level trades speed for ratio, and level 0 only stores the data. For bzip2 the level is the block size in units
+// of 100 KB (dsnet's WriterConfig.Level, like bzip2 -1 to -9), which usually moves the ratio
+// by only a few percent. zstd levels 1-22 map onto the encoder's four speed settings the same
+// way the klauspost library maps zstd command line levels. xz levels pick the dictionary size of
+// the matching xz -1 to -9 preset, and brotli levels are spread over its qualities 0-11. lz4
+// level 1 is its fast compressor and levels 2-9 the high compression ones, as with lz4 -1 to -9
+// snappy has no levels, so it accepts any, ignores it, and writes the framed stream format
+// Only gzip and zstd can start from a preset dictionary. The gzip format has no place for one,
+// so gzip with a dictionary is measured as the zlib stream of the same deflate data, which has
+// only a few bytes more of header. zstd takes a dictionary trained with zstd --train as it
+// is, and any other file as raw content
+var compressionAlgorithms = map[string]compressionAlgorithm{
+	"gzip": {minLevel: 0, maxLevel: 9, defaultLevel: 9, newWriter: func(w io.Writer, compressionLevel int) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, compressionLevel)
+	}, newDictionaryWriter: func(w io.Writer, compressionLevel int, dictionary []byte) (io.WriteCloser, error) {
+		return zlib.NewWriterLevelDict(w, compressionLevel, dictionary)
+	}, reach: 32 << 10},
+	"bzip2": {minLevel: 1, maxLevel: 9, defaultLevel: 9, newWriter: func(w io.Writer, compressionLevel int) (io.WriteCloser, error) {
+		return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: compressionLevel}) // Requires "github.com/dsnet/compress/bzip2"
+	}, reach: 0},
+	"zstd": {minLevel: 1, maxLevel: 22, defaultLevel: 3, newWriter: func(w io.Writer, compressionLevel int) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionLevel))) // Requires "github.com/klauspost/compress/zstd"
+	}, newDictionaryWriter: func(w io.Writer, compressionLevel int, dictionary []byte) (io.WriteCloser, error) {
+		dictionaryOption := zstd.WithEncoderDictRaw(0, dictionary)
+		if bytes.HasPrefix(dictionary, zstdDictionaryMagic) {
+			dictionaryOption = zstd.WithEncoderDict(dictionary)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionLevel)), dictionaryOption)
+	}, reach: math.MaxInt},
+	"xz": {minLevel: 1, maxLevel: 9, defaultLevel: 6, newWriter: func(w io.Writer, compressionLevel int) (io.WriteCloser, error) {
+		return xz.WriterConfig{DictCap: xzDictCap(compressionLevel)}.NewWriter(w) // Requires "github.com/ulikunitz/xz"
+	}, reach: 1 << 20}, // The dictionary of level 1; the higher levels have larger ones
+	"brotli": {minLevel: 1, maxLevel: 9, defaultLevel: 9, newWriter: func(w io.Writer, compressionLevel int) (io.WriteCloser, error) {
+		return brotli.NewWriterLevel(w, brotliQuality(compressionLevel)), nil // Requires "github.com/andybalholm/brotli"
+	}, reach: 4 << 20},
+	"lz4": {minLevel: 1, maxLevel: 9, defaultLevel: 1, newWriter: func(w io.Writer, compressionLevel int) (io.WriteCloser, error) {
+		writer := lz4.NewWriter(w) // Requires "github.com/pierrec/lz4/v4"
+		if err := writer.Apply(lz4.CompressionLevelOption(lz4Level(compressionLevel))); err != nil {
+			return nil, err
+		}
+		return writer, nil
+	}, reach: 64 << 10},
+	"snappy": {minLevel: math.MinInt, maxLevel: math.MaxInt, defaultLevel: 0, newWriter: func(w io.Writer, compressionLevel int) (io.WriteCloser, error) {
+		return snappy.NewBufferedWriter(w), nil // Requires "github.com/golang/snappy"
+	}, reach: 0},
+}
+
+// The first bytes of a dictionary trained with zstd --train
+var zstdDictionaryMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+
+// Look up an algorithm, defaulting to gzip
+func lookupAlgorithm(compressionAlgorithm string) compressionAlgorithm {
+	if algorithm, ok := compressionAlgorithms[compressionAlgorithm]; ok {
+		return algorithm
+	}
+	return compressionAlgorithms["gzip"]
+}
+
+// Lowest compression level of an algorithm
+// gzip has a level 0 that stores the data without compressing it; the others start at 1
+func MinCompressionLevel(compressionAlgorithm string) int {
+	return lookupAlgorithm(compressionAlgorithm).minLevel
+}
+
+// Highest compression level of an algorithm
+// zstd follows the zstd command line tool's 1-22 scale, the others use 1-9
+func MaxCompressionLevel(compressionAlgorithm string) int {
+	return lookupAlgorithm(compressionAlgorithm).maxLevel
+}
+
+// Compression level of an algorithm when none is given, the same as its command line tool's:
+// 9 for gzip, bzip2 and brotli (quality 11), 3 for zstd, 6 for xz and 1 (fast) for lz4
+func DefaultCompressionLevel(compressionAlgorithm string) int {
+	return lookupAlgorithm(compressionAlgorithm).defaultLevel
+}
+
+// Report whether the compression level makes any difference to an algorithm
+func HasCompressionLevels(compressionAlgorithm string) bool {
+	return lookupAlgorithm(compressionAlgorithm).minLevel != math.MinInt
+}
+
+// Report whether an algorithm can start from a preset dictionary
+func SupportsDictionary(compressionAlgorithm string) bool {
+	return lookupAlgorithm(compressionAlgorithm).newDictionaryWriter != nil
+}
+
+// Wrap a writer with the compressor for the given algorithm and level, defaulting to gzip
+// A dictionary is used if it is not nil and the algorithm supports one
+// Levels outside the algorithm's range are an error rather than being clamped
+func newCompressionWriter(w io.Writer, compressionLevel int, compressionAlgorithm string, dictionary []byte) (io.WriteCloser, error) {
+	algorithm := lookupAlgorithm(compressionAlgorithm)
+	if compressionLevel < algorithm.minLevel || compressionLevel > algorithm.maxLevel {
+		return nil, fmt.Errorf("invalid compression level %d for %s, which takes %d to %d", compressionLevel, compressionAlgorithm, algorithm.minLevel, algorithm.maxLevel)
+	}
+	if dictionary != nil && algorithm.newDictionaryWriter != nil {
+		return algorithm.newDictionaryWriter(w, compressionLevel, dictionary)
+	}
+	return algorithm.newWriter(w, compressionLevel)
+}
+
+// progressCallback is called from the compression goroutine after every read from the input,
+// with the uncompressed bytes read and the compressed bytes produced so far
+// Compressors buffer their output, so bytesOut lags behind bytesIn, by a whole block for
+// bzip2 and xz. flush pushes out what the compressor holds, for those whose writer can, and
+// returns bytesOut after it; it costs a few bytes of output, so it is meant to be called
+// now and then rather than on every read
+// Returning false stops the compression early, as if the input had ended
+type progressCallback func(bytesIn, bytesOut int64, flush func() int64) bool
+
+// Compress data using the writer registered for compressionAlgorithm in compressionAlgorithms
+// compress the data from the sampled data stream, not saving the compressed data; just the compressed size
+// The compression ratio is calculated as the size of the compressed data divided by the size of the uncompressed data
+// If onProgress is not nil it is called as the data is compressed, so callers can follow a running ratio
+// The compressor starts from the preset dictionary, if one is given
+// The function returns the compression ratio as a float64, or errNothingSampled if the input was empty
+func compressData(uncompressedInput io.Reader, compressionLevel int, compressionAlgorithm string, dictionary []byte, onProgress progressCallback) (float64, error) {
+	compressedSize := float64(0)
+	uncompressedSize := float64(0)
+
+	// Create a pipe to stream the compressed data
+	// Write compressed data directly into the pipe
+	// Read the compressed data size from the other end
+	compressedDataPipe, compressedDataWriter := io.Pipe()
+
+	go func() {
+		// Count the compressed bytes as they are produced, for the progress callback
+		compressedCounter := &countingWriter{w: compressedDataWriter}
+		writer, err := newCompressionWriter(compressedCounter, compressionLevel, compressionAlgorithm, dictionary)
+		if err != nil {
+			compressedDataWriter.CloseWithError(err)
+			return
+		}
+
+		// Flush the compressor for the progress callback, if it can be
+		var flushErr error
+		flush := func() int64 {
+			if flusher, ok := writer.(interface{ Flush() error }); ok && flushErr == nil {
+				flushErr = flusher.Flush()
+			}
+			return compressedCounter.n
+		}
+
+		buf := make([]byte, COPY_BUFFER_SIZE)
+		for {
+			// Read from the uncompressed input stream into the buffer
+			n, err := uncompressedInput.Read(buf)
+			if n > 0 {
+				// keep track of the uncompressed size (to calculate the compression ratio)
+				uncompressedSize += float64(n)
+				if err := writeFull(writer, buf[:n]); err != nil {
+					compressedDataWriter.CloseWithError(err)
+					return
+				}
+				if onProgress != nil {
+					more := onProgress(int64(uncompressedSize), compressedCounter.n, flush)
+					if flushErr != nil {
+						compressedDataWriter.CloseWithError(flushErr)
+						return
+					}
+					if !more {
+						break
+					}
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				compressedDataWriter.CloseWithError(err)
+				return
+			}
+		}
+
+		// Close the compressor before the pipe, so that the final block it flushes is counted
+		if err := writer.Close(); err != nil {
+			compressedDataWriter.CloseWithError(err)
+			return
+		}
+		compressedDataWriter.Close()
+	}()
+
+	buf := make([]byte, COPY_BUFFER_SIZE)
+	for {
+		n, err := compressedDataPipe.Read(buf)
+		compressedSize += float64(n)
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return compressedSize, err
+		}
+	}
+
+	if uncompressedSize == 0 {
+		return 0, errNothingSampled
+	}
+	return compressedSize / uncompressedSize, nil
+}
+
+// errNothingSampled is returned when there was no data to compress, so no ratio can be
+// measured: the files are empty, or all of them fell between sample points
+var errNothingSampled = errors.New("no data to sample")
+
+// countingWriter keeps count of the bytes written to it, passing them on to w if it is set
+// and discarding them otherwise
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.w == nil {
+		w.n += int64(len(p))
+		return len(p), nil
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Write all of p to w, writing again whatever a short write left over
+// A writer that takes nothing without an error gets io.ErrShortWrite, as it does from io.Copy,
+// rather than being retried forever
+func writeFull(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+		if n <= 0 || n > len(p) {
+			return io.ErrShortWrite
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// Compress a buffer on its own, from the dictionary if one is given, and return the size of
+// the compressed output
+func compressedLength(data []byte, compressionLevel int, compressionAlgorithm string, dictionary []byte) (int64, error) {
+	counter := &countingWriter{}
+	writer, err := newCompressionWriter(counter, compressionLevel, compressionAlgorithm, dictionary)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return 0, err
+	}
+	// Closing flushes the final block, which must be counted too
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// Compress the sampled data stream in windows of windowSize bytes spread over several workers
+// Each window is compressed on its own, so matches cannot reach back into the previous window
+// and every window pays for its own header. The ratio is therefore slightly higher than that
+// of one continuous stream, by less the larger the windows are. With a dictionary, every
+// window starts from it
+// The function returns the compression ratio and the ratio of every window, or
+// errNothingSampled if the input was empty
+func compressParallel(uncompressedInput io.Reader, windowSize int64, workers int, compressionLevel int, compressionAlgorithm string, dictionary []byte) (float64, []float64, error) {
+	var compressedSize, uncompressedSize atomic.Int64
+	var ratiosMutex sync.Mutex
+	var ratios []float64
+	windows := make(chan []byte, workers)
+	errs := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var workerErr error
+			for window := range windows {
+				if workerErr != nil {
+					continue // Drain the remaining windows so the reader is not blocked
+				}
+				n, err := compressedLength(window, compressionLevel, compressionAlgorithm, dictionary)
+				if err != nil {
+					workerErr = err
+					continue
+				}
+				compressedSize.Add(n)
+				uncompressedSize.Add(int64(len(window)))
+				ratiosMutex.Lock()
+				ratios = append(ratios, float64(n)/float64(len(window)))
+				ratiosMutex.Unlock()
+			}
+			errs <- workerErr
+		}()
+	}
+
+	// Cut the stream into windows and hand them out to the workers
+	var readErr error
+	for {
+		window := make([]byte, windowSize)
+		n, err := io.ReadFull(uncompressedInput, window)
+		if n > 0 {
+			windows <- window[:n]
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	close(windows)
+	wg.Wait()
+	close(errs)
+
+	if readErr != nil {
+		return 0, nil, readErr
+	}
+	for err := range errs {
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if uncompressedSize.Load() == 0 {
+		return 0, nil, errNothingSampled
+	}
+	return float64(compressedSize.Load()) / float64(uncompressedSize.Load()), ratios, nil
+}
+
+// Compress the sampled data stream with several algorithms at once, reading it only once
+// A copy of the stream is fed to one compressor per algorithm, all at the same level
+// The function returns the compression ratio of each algorithm, in order, or
+// errNothingSampled if the input was empty
+func compressAll(uncompressedInput io.Reader, compressionLevel int, compressionAlgorithms []string) ([]float64, error) {
+	ratios := make([]float64, len(compressionAlgorithms))
+	errs := make([]error, len(compressionAlgorithms))
+	writers := make([]io.Writer, len(compressionAlgorithms))
+	pipeWriters := make([]*io.PipeWriter, len(compressionAlgorithms))
+
+	var wg sync.WaitGroup
+	for i, algorithm := range compressionAlgorithms {
+		pipeReader, pipeWriter := io.Pipe()
+		writers[i], pipeWriters[i] = pipeWriter, pipeWriter
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ratios[i], errs[i] = compressData(pipeReader, compressionLevel, algorithm, nil, nil)
+			// Stop the copy below if this compressor failed
+			pipeReader.CloseWithError(errs[i])
+		}()
+	}
+
+	_, err := io.Copy(io.MultiWriter(writers...), uncompressedInput)
+	for _, pipeWriter := range pipeWriters {
+		pipeWriter.CloseWithError(err)
+	}
+	wg.Wait()
+
+	for _, compressErr := range errs {
+		if compressErr != nil {
+			return nil, compressErr
+		}
+	}
+	// A compressor that failed closes its pipe, which the copy reports as a closed pipe
+	if err != nil {
+		return nil, err
+	}
+	return ratios, nil
+}
+
+// windowProgress records the compression ratio of every window of at least size bytes of a
+// single continuous stream, from the stream's own progress: the compressor is flushed at the
+// end of each window, and the window's ratio is the compressed bytes it added over its size
+// The windows are compressed with the history of those before them, so each ratio is a little
+// lower than compressing the window on its own, as compressParallel does
+// Compressors that cannot be flushed hand out their output a block at a time, so no ratios
+// are recorded for them
+type windowProgress struct {
+	size    int64
+	flushes bool
+	bytesIn int64
+	lastIn  int64
+	lastOut int64
+	prevIn  int64
+	prevOut int64
+	ratios  []float64
+}
+
+func newWindowProgress(size int64, compressionLevel int, compressionAlgorithm string, dictionary []byte) *windowProgress {
+	return &windowProgress{size: size, flushes: canFlush(compressionLevel, compressionAlgorithm, dictionary)}
+}
+
+// The progress callback for compressData
+func (w *windowProgress) progress(bytesIn, bytesOut int64, flush func() int64) bool {
+	w.bytesIn = bytesIn
+	if !w.flushes || bytesIn-w.lastIn < w.size {
+		return true
+	}
+	w.record(bytesIn, flush())
+	return true
+}
+
+// Record the last, partial window from the ratio of the whole stream
+// A last window under half the size is folded into the one before it, so that the few bytes
+// of the container's trailer are not taken as a ratio of their own
+func (w *windowProgress) finish(ratio float64) {
+	if !w.flushes || w.bytesIn == w.lastIn {
+		return
+	}
+	if len(w.ratios) > 0 && w.bytesIn-w.lastIn < w.size/2 {
+		w.ratios = w.ratios[:len(w.ratios)-1]
+		w.lastIn, w.lastOut = w.prevIn, w.prevOut
+	}
+	w.record(w.bytesIn, int64(math.Round(ratio*float64(w.bytesIn))))
+}
+
+func (w *windowProgress) record(bytesIn, bytesOut int64) {
+	w.ratios = append(w.ratios, float64(bytesOut-w.lastOut)/float64(bytesIn-w.lastIn))
+	w.prevIn, w.prevOut = w.lastIn, w.lastOut
+	w.lastIn, w.lastOut = bytesIn, bytesOut
+}
+
+// Report whether the writer for the algorithm can push out the data it holds part way
+func canFlush(compressionLevel int, compressionAlgorithm string, dictionary []byte) bool {
+	writer, err := newCompressionWriter(io.Discard, compressionLevel, compressionAlgorithm, dictionary)
+	if err != nil {
+		return false
+	}
+	defer writer.Close()
+	_, ok := writer.(interface{ Flush() error })
+	return ok
+}
+
+// Half the width of the 95% confidence interval of the mean of the window ratios
+// The windows are treated as independent draws of the ratio, which holds roughly since each
+// one comes from a different chunk of the files. At least two windows are needed
+func ratioMargin(ratios []float64) (float64, bool) {
+	n := float64(len(ratios))
+	if n < 2 {
+		return 0, false
+	}
+	mean := float64(0)
+	for _, ratio := range ratios {
+		mean += ratio
+	}
+	mean /= n
+	variance := float64(0)
+	for _, ratio := range ratios {
+		variance += (ratio - mean) * (ratio - mean)
+	}
+	variance /= n - 1
+	return CONFIDENCE_Z * math.Sqrt(variance/n), true
+}
+
+// Adaptively compress the sampled data stream, checking the running ratio after every window
+// The running ratio is taken from the compression progress each time another windowSize
+// bytes have been compressed, flushing the compressor first where it can be. Sampling stops
+// once it has changed by less than tolerance (relative) for ADAPTIVE_STABLE_WINDOWS
+// consecutive windows, or when maxSample bytes have been drawn (0 means no limit)
+// Compressors that cannot be flushed hold back whole blocks, so a window only counts as
+// stable if the compressor produced output during it; until then the ratio is unknown
+// The function returns the compression ratio and the number of bytes it took to converge
+func compressAdaptive(uncompressedInput io.ReadCloser, windowSize, maxSample int64, tolerance float64, compressionLevel int, compressionAlgorithm string, dictionary []byte, verbose bool) (float64, int64, error) {
+	defer uncompressedInput.Close()
+
+	sampledBytes := int64(0)
+	ratio := float64(0)
+	windows := int64(0)
+	stableWindows := 0
+	lastBytesOut := int64(0)
+
+	onProgress := func(bytesIn, bytesOut int64, flush func() int64) bool {
+		sampledBytes = bytesIn
+		if maxSample > 0 && bytesIn >= maxSample {
+			return false
+		}
+		if bytesIn/windowSize == windows {
+			return true
+		}
+		windows = bytesIn / windowSize
+
+		bytesOut = flush()
+		runningRatio := float64(bytesOut) / float64(bytesIn)
+		produced := bytesOut > lastBytesOut
+		lastBytesOut = bytesOut
+		if windows > 1 && produced && ratio > 0 && math.Abs(runningRatio-ratio) <= tolerance*ratio {
+			stableWindows++
+		} else {
+			stableWindows = 0
+		}
+		ratio = runningRatio
+
+		if stableWindows >= ADAPTIVE_STABLE_WINDOWS {
+			if verbose {
+				log.Printf("Adaptive sampling converged after %d windows", windows)
+			}
+			return false
+		}
+		return true
+	}
+
+	compressedRatio, err := compressData(uncompressedInput, compressionLevel, compressionAlgorithm, dictionary, onProgress)
+	return compressedRatio, sampledBytes, err
+}
+
+// Compress the sampled data stream twice at once: as is, and after encrypting it
+// The encryption is AES-CTR under a random key, which stands in for any real cipher: its
+// output looks random, so compressing it afterwards gains nothing
+// The function returns the compression ratio of both orderings
+func compressBothOrders(uncompressedInput io.Reader, compressionLevel int, compressionAlgorithm string) (float64, float64, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := crand.Read(key); err != nil {
+		return 0, 0, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Feed a copy of the sample through the cipher into a second compressor
+	encryptedInput, encryptedInputWriter := io.Pipe()
+	encryptedRatio := float64(0)
+	encryptedDone := make(chan error, 1)
+	go func() {
+		ratio, err := compressData(cipher.StreamReader{S: cipher.NewCTR(block, iv), R: encryptedInput}, compressionLevel, compressionAlgorithm, nil, nil)
+		encryptedRatio = ratio
+		encryptedInput.CloseWithError(err)
+		encryptedDone <- err
+	}()
+
+	ratio, err := compressData(io.TeeReader(uncompressedInput, encryptedInputWriter), compressionLevel, compressionAlgorithm, nil, nil)
+	encryptedInputWriter.CloseWithError(err)
+	if encryptedErr := <-encryptedDone; err == nil {
+		err = encryptedErr
+	}
+	return ratio, encryptedRatio, err
+}
+
+// Read up to size bytes of an existing archive's decompressed contents
+// gzip and bzip2 archives are recognized by their magic bytes; anything else (e.g. a plain
+// tar) is read as is
+func readArchivePrimer(path string, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var contents io.Reader
+	buffered := bufio.NewReader(f)
+	magic, _ := buffered.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		contents = gzipReader
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		bzip2Reader, err := bzip2.NewReader(buffered, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer bzip2Reader.Close()
+		contents = bzip2Reader
+	default:
+		contents = buffered
+	}
+
+	return io.ReadAll(io.LimitReader(contents, size))
+}
+
+// Compress the sampled data stream one window at a time, with the compressor primed by primer
+// This models adding the data to an archive whose compressor has already seen the primer, so
+// redundancy shared with the existing archive is not paid for twice
+// gzip and zstd start each window from the primer as a preset dictionary. The others have
+// none, so the marginal size of a window is the size of primer+window compressed together
+// minus the size of primer compressed alone, with the primer cut to the compressor's reach:
+// lz4 keeps 64 KB of it, and bzip2 and snappy, which compress each block on their own, none,
+// so the archive makes no difference to them. xz and brotli reach past the whole primer and
+// compress all of it again with every window
+// The function returns the marginal compression ratio
+func compressPrimed(uncompressedInput io.Reader, primer []byte, windowSize int64, compressionLevel int, compressionAlgorithm string) (float64, error) {
+	algorithm := lookupAlgorithm(compressionAlgorithm)
+	dictionary := algorithm.newDictionaryWriter != nil
+	if !dictionary {
+		primer = primer[len(primer)-min(len(primer), algorithm.reach):]
+	}
+	// The compressed size of the primer followed by what comes after it in primed
+	compressed := func(primed []byte) (int64, error) {
+		if dictionary {
+			return compressedLength(primed[len(primer):], compressionLevel, compressionAlgorithm, primer)
+		}
+		return compressedLength(primed, compressionLevel, compressionAlgorithm, nil)
+	}
+	primerSize, err := compressed(primer)
+	if err != nil {
+		return 0, err
+	}
+
+	marginalSize := int64(0)
+	uncompressedSize := int64(0)
+
+	buf := make([]byte, int64(len(primer))+windowSize)
+	copy(buf, primer)
+	for {
+		n, err := io.ReadFull(uncompressedInput, buf[len(primer):])
+		if n > 0 {
+			size, cerr := compressed(buf[:len(primer)+n])
+			if cerr != nil {
+				return 0, cerr
+			}
+			marginalSize += max(size-primerSize, 0)
+			uncompressedSize += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uncompressedSize == 0 {
+		return 0, errNothingSampled
+	}
+	return float64(marginalSize) / float64(uncompressedSize), nil
+}
@@ -0,0 +1,231 @@
+package sizer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Readers that undo each of the compressionAlgorithms
+var decompressors = map[string]func(io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"bzip2": func(r io.Reader) (io.Reader, error) {
+		return bzip2.NewReader(r, nil)
+	},
+	"zstd": func(r io.Reader) (io.Reader, error) {
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	},
+	"xz":     func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+	"brotli": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	"lz4":    func(r io.Reader) (io.Reader, error) { return lz4.NewReader(r), nil },
+	"snappy": func(r io.Reader) (io.Reader, error) { return snappy.NewReader(r), nil },
+}
+
+// Text that compresses well but not to nothing
+func compressibleData() []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 256<<10; i++ {
+		fmt.Fprintf(&buf, "%08d the quick brown fox jumps over the lazy dog %x\n", i, i*i)
+	}
+	return buf.Bytes()
+}
+
+// Compress data into a buffer with an algorithm at a level
+func compressBuffer(t *testing.T, data []byte, compressionLevel int, compressionAlgorithm string) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	writer, err := newCompressionWriter(&compressed, compressionLevel, compressionAlgorithm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFull(writer, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func TestCompressionAlgorithmsRoundTrip(t *testing.T) {
+	if len(compressionAlgorithms) != len(CompressionAlgorithms) {
+		t.Fatalf("%d algorithms are implemented but %d are listed", len(compressionAlgorithms), len(CompressionAlgorithms))
+	}
+	data := compressibleData()
+	for _, algorithm := range CompressionAlgorithms {
+		levels := []int{DefaultCompressionLevel(algorithm)}
+		if HasCompressionLevels(algorithm) {
+			levels = append(levels, MinCompressionLevel(algorithm), MaxCompressionLevel(algorithm))
+		}
+		for _, level := range levels {
+			t.Run(fmt.Sprintf("%s-%d", algorithm, level), func(t *testing.T) {
+				compressed := compressBuffer(t, data, level, algorithm)
+				reader, err := decompressors[algorithm](bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatal(err)
+				}
+				decompressed, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decompressed, data) {
+					t.Errorf("decompressed %d bytes that differ from the %d compressed", len(decompressed), len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestCompressDataRatio(t *testing.T) {
+	data := compressibleData()
+	for _, algorithm := range CompressionAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			level := DefaultCompressionLevel(algorithm)
+			ratio, err := compressData(bytes.NewReader(data), level, algorithm, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ratio <= 0 || ratio > 1 {
+				t.Errorf("ratio %v is not in (0, 1]", ratio)
+			}
+			// The ratio is that of the whole compressed output, final block included
+			want := float64(len(compressBuffer(t, data, level, algorithm))) / float64(len(data))
+			if ratio != want {
+				t.Errorf("ratio %v, want %v", ratio, want)
+			}
+		})
+	}
+}
+
+func TestWindowProgress(t *testing.T) {
+	data := compressibleData()
+	const size = 64 << 10
+	for _, algorithm := range CompressionAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			level := DefaultCompressionLevel(algorithm)
+			windows := newWindowProgress(size, level, algorithm, nil)
+			ratio, err := compressData(bytes.NewReader(data), level, algorithm, nil, windows.progress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			windows.finish(ratio)
+			if !windows.flushes {
+				if algorithm == "gzip" || algorithm == "zstd" {
+					t.Fatalf("%s cannot be flushed", algorithm)
+				}
+				if len(windows.ratios) != 0 {
+					t.Errorf("recorded %d windows of a compressor that cannot be flushed", len(windows.ratios))
+				}
+				return
+			}
+			// Every window is at least size bytes, save the last
+			if n := len(windows.ratios); n < 2 || n > len(data)/size+1 {
+				t.Errorf("recorded %d windows of %d bytes", n, len(data))
+			}
+			for i, windowRatio := range windows.ratios {
+				if windowRatio <= 0 || windowRatio > 1 {
+					t.Errorf("window %d has ratio %v", i, windowRatio)
+				}
+			}
+			// The windows add up to the whole stream
+			if windows.lastIn != int64(len(data)) {
+				t.Errorf("the windows cover %d bytes, want %d", windows.lastIn, len(data))
+			}
+		})
+	}
+}
+
+func TestGzipLevelZeroStores(t *testing.T) {
+	// About 1 MB of text, which gzip level 0 stores as is, adding only its headers
+	var data bytes.Buffer
+	for data.Len() < 1<<20 {
+		data.Write(compressibleData())
+	}
+	ratio, err := compressData(bytes.NewReader(data.Bytes()), 0, "gzip", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ratio <= 1 || ratio > 1.001 {
+		t.Errorf("ratio %v at level 0, want just above 1", ratio)
+	}
+}
+
+func TestCompressPrimed(t *testing.T) {
+	// The samples repeat the last 16 KB of the primer, which is within every compressor's reach
+	primer := compressibleData()[:64<<10]
+	samples := primer[len(primer)-16<<10:]
+	for _, algorithm := range CompressionAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			level := DefaultCompressionLevel(algorithm)
+			unprimed, err := compressPrimed(bytes.NewReader(samples), nil, 4<<10, level, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			primed, err := compressPrimed(bytes.NewReader(samples), primer, 4<<10, level, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lookupAlgorithm(algorithm).reach == 0 {
+				if primed != unprimed {
+					t.Errorf("primed ratio %v, want %v as without a primer", primed, unprimed)
+				}
+			} else if primed > unprimed/2 {
+				t.Errorf("primed ratio %v, want well under the %v without a primer", primed, unprimed)
+			}
+		})
+	}
+}
+
+func TestCompressDataNothingSampled(t *testing.T) {
+	if _, err := compressData(bytes.NewReader(nil), COMPRESSION_LEVEL, "gzip", nil, nil); !errors.Is(err, errNothingSampled) {
+		t.Errorf("compressing nothing gave %v, want %v", err, errNothingSampled)
+	}
+}
+
+func TestInvalidCompressionLevels(t *testing.T) {
+	data := compressibleData()
+	for _, algorithm := range CompressionAlgorithms {
+		if !HasCompressionLevels(algorithm) {
+			continue
+		}
+		for _, level := range []int{MinCompressionLevel(algorithm) - 1, MaxCompressionLevel(algorithm) + 1} {
+			if _, err := compressData(bytes.NewReader(data), level, algorithm, nil, nil); err == nil {
+				t.Errorf("%s accepted level %d", algorithm, level)
+			}
+		}
+	}
+}
+
+// shortWriter takes at most limit bytes per write
+type shortWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	return w.Buffer.Write(p[:min(len(p), w.limit)])
+}
+
+func TestWriteFull(t *testing.T) {
+	w := &shortWriter{limit: 3}
+	if err := writeFull(w, []byte("abcdefghij")); err != nil || w.String() != "abcdefghij" {
+		t.Errorf("writeFull wrote %q, %v", w.String(), err)
+	}
+	if err := writeFull(&shortWriter{limit: 0}, []byte("abc")); err != io.ErrShortWrite {
+		t.Errorf("writing to a writer that takes nothing gave %v, want %v", err, io.ErrShortWrite)
+	}
+}
@@ -0,0 +1,224 @@
+package sizer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Check whether a path given in place of a directory is an archive whose entries OpenArchives
+// lists: a .tar or .zip file
+func isArchive(path string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
+	return extension == ".tar" || extension == ".zip"
+}
+
+// List the regular files stored in a tar or zip archive as if they were the files of a
+// directory, at their uncompressed size
+// Each entry is listed under the archive's path joined with its name, and the filter applies
+// to those paths as to the files of a walk; the maximum depth does not. The entries are read
+// from the archive when they are sampled, so their contents are never held in memory
+// Entries that cannot be read as they are stored, such as encrypted zip entries or ones
+// compressed with a method other than deflate, are reported to errorLog and skipped
+func listArchiveEntries(ctx context.Context, archivePath string, filter *fileFilter, errorLog io.Writer, fileInfoChan chan<- FileInfo) {
+	send := func(name string, size int64, open func() (sampledReader, error)) bool {
+		path := filepath.Join(archivePath, filepath.FromSlash(name))
+		if filter.excludes(archivePath, path) || !filter.includes(path) || !filter.sizeIncluded(size) {
+			return true
+		}
+		return sendFile(ctx, fileInfoChan, FileInfo{Path: path, Size: size, open: open})
+	}
+
+	var err error
+	if strings.ToLower(filepath.Ext(archivePath)) == ".zip" {
+		err = listZipEntries(archivePath, errorLog, send)
+	} else {
+		err = listTarEntries(archivePath, send)
+	}
+	if err != nil {
+		fmt.Fprintf(errorLog, "Error reading archive %s: %v\n", archivePath, err)
+	}
+}
+
+// List the regular files of a tar archive
+// The archive is not compressed, so every entry is read straight from where its data lies
+// in it. Sparse entries are skipped, as what is stored of them is not their contents
+func listTarEntries(archivePath string, send func(name string, size int64, open func() (sampledReader, error)) bool) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tarReader := tar.NewReader(f)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || sparseTarEntry(header) {
+			continue
+		}
+		// The reader has read the entry's headers and nothing more, so the file is at its data
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		size := header.Size
+		open := func() (sampledReader, error) {
+			archive, err := os.Open(archivePath)
+			if err != nil {
+				return nil, err
+			}
+			return sectionEntry{io.NewSectionReader(archive, offset, size), archive}, nil
+		}
+		if !send(header.Name, size, open) {
+			return nil
+		}
+	}
+}
+
+// Check whether a tar entry is a sparse file in the PAX format
+func sparseTarEntry(header *tar.Header) bool {
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// List the regular files of a zip archive
+// Stored entries are read straight from the archive, and deflated ones are decompressed as
+// they are read
+func listZipEntries(archivePath string, errorLog io.Writer, send func(name string, size int64, open func() (sampledReader, error)) bool) error {
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+
+	for _, entry := range zipReader.File {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		if entry.Flags&0x1 != 0 {
+			fmt.Fprintf(errorLog, "Error reading archive entry %s: it is encrypted, skipping it\n", entry.Name)
+			continue
+		}
+		if entry.Method != zip.Store && entry.Method != zip.Deflate {
+			fmt.Fprintf(errorLog, "Error reading archive entry %s: unsupported compression method %d, skipping it\n", entry.Name, entry.Method)
+			continue
+		}
+		offset, err := entry.DataOffset()
+		if err != nil {
+			fmt.Fprintf(errorLog, "Error reading archive entry %s: %v, skipping it\n", entry.Name, err)
+			continue
+		}
+
+		storedSize := int64(entry.CompressedSize64)
+		openStored := func() (*os.File, *io.SectionReader, error) {
+			archive, err := os.Open(archivePath)
+			if err != nil {
+				return nil, nil, err
+			}
+			return archive, io.NewSectionReader(archive, offset, storedSize), nil
+		}
+		var open func() (sampledReader, error)
+		if entry.Method == zip.Store {
+			open = func() (sampledReader, error) {
+				archive, section, err := openStored()
+				if err != nil {
+					return nil, err
+				}
+				return sectionEntry{section, archive}, nil
+			}
+		} else {
+			open = func() (sampledReader, error) {
+				return &sequentialEntry{open: func() (io.ReadCloser, error) {
+					archive, section, err := openStored()
+					if err != nil {
+						return nil, err
+					}
+					return inflatedEntry{flate.NewReader(section), archive}, nil
+				}}, nil
+			}
+		}
+		if !send(entry.Name, int64(entry.UncompressedSize64), open) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// sectionEntry is an archive entry stored as is, read from its part of the archive file
+type sectionEntry struct {
+	*io.SectionReader
+	archive *os.File
+}
+
+func (e sectionEntry) Close() error {
+	return e.archive.Close()
+}
+
+// inflatedEntry decompresses a deflated zip entry from the archive file
+type inflatedEntry struct {
+	io.ReadCloser
+	archive *os.File
+}
+
+func (e inflatedEntry) Close() error {
+	e.ReadCloser.Close()
+	return e.archive.Close()
+}
+
+// sequentialEntry reads an entry that can only be decompressed from its start as if it could
+// be read at any offset
+// The samples of an entry are read in order, so the data between them is decompressed and
+// thrown away; a read behind the last one starts the decompression over
+type sequentialEntry struct {
+	open   func() (io.ReadCloser, error)
+	reader io.ReadCloser
+	offset int64 // Offset the reader is at
+}
+
+func (e *sequentialEntry) ReadAt(p []byte, off int64) (int, error) {
+	if e.reader == nil || off < e.offset {
+		e.Close()
+		reader, err := e.open()
+		if err != nil {
+			return 0, err
+		}
+		e.reader, e.offset = reader, 0
+	}
+
+	skipped, err := io.CopyN(io.Discard, e.reader, off-e.offset)
+	e.offset += skipped
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(e.reader, p)
+	e.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (e *sequentialEntry) Close() error {
+	if e.reader == nil {
+		return nil
+	}
+	err := e.reader.Close()
+	e.reader = nil
+	return err
+}
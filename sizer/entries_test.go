@@ -0,0 +1,205 @@
+package sizer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Contents of the files stored in the test archives, by name
+var archivedFiles = map[string]string{
+	"a.txt":         strings.Repeat("a line of text\n", 1000),
+	"docs/b.txt":    "a short file",
+	"docs/deep/c.c": strings.Repeat("int main() { return 0; }\n", 300),
+	"empty":         "",
+}
+
+func writeTestTar(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	headers := []*tar.Header{
+		{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "a.txt"},
+		{Name: "fifo", Typeflag: tar.TypeFifo},
+	}
+	for _, header := range headers {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a.txt", "docs/b.txt", "docs/deep/c.c", "empty"} {
+		content := archivedFiles[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestZip(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	if _, err := zw.Create("docs/"); err != nil {
+		t.Fatal(err)
+	}
+	// Stored and deflated entries, which are read, and ones that cannot be
+	methods := map[string]uint16{"a.txt": zip.Deflate, "docs/b.txt": zip.Store, "docs/deep/c.c": zip.Deflate, "empty": zip.Store}
+	for _, name := range []string{"a.txt", "docs/b.txt", "docs/deep/c.c", "empty"} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: methods[name]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(archivedFiles[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encrypted, err := zw.CreateRaw(&zip.FileHeader{Name: "secret", Method: zip.Store, Flags: 0x1, CompressedSize64: 4, UncompressedSize64: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted.Write([]byte("xxxx"))
+	bzipped, err := zw.CreateRaw(&zip.FileHeader{Name: "bzipped", Method: 12, CompressedSize64: 4, UncompressedSize64: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bzipped.Write([]byte("xxxx"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// List the entries of an archive given in place of a directory, by name relative to it
+func listEntries(t *testing.T, archivePath string, opts Options) (map[string]FileInfo, string) {
+	t.Helper()
+	var errorLog strings.Builder
+	fileInfoChan := make(chan FileInfo)
+	go listFilesWithSizes(context.Background(), archivePath, opts.filter(), &errorLog, fileInfoChan)
+
+	entries := make(map[string]FileInfo)
+	for file := range fileInfoChan {
+		name, err := filepath.Rel(archivePath, file.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[filepath.ToSlash(name)] = file
+	}
+	return entries, errorLog.String()
+}
+
+func TestListArchiveEntries(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTar(t, filepath.Join(dir, "test.tar"))
+	writeTestZip(t, filepath.Join(dir, "test.zip"))
+
+	for _, archive := range []string{"test.tar", "test.zip"} {
+		t.Run(archive, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.OpenArchives = true
+			entries, errorLog := listEntries(t, filepath.Join(dir, archive), opts)
+
+			if len(entries) != len(archivedFiles) {
+				t.Errorf("listed %d entries, want %d: %v", len(entries), len(archivedFiles), entries)
+			}
+			for name, content := range archivedFiles {
+				entry, ok := entries[name]
+				if !ok {
+					t.Errorf("%s is not listed", name)
+					continue
+				}
+				if entry.Size != int64(len(content)) {
+					t.Errorf("%s is listed at %d bytes, want %d", name, entry.Size, len(content))
+				}
+
+				// Every entry reads back as it was stored, wherever the read starts
+				reader, err := openSampled(entry, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, offset := range []int64{0, entry.Size / 2, entry.Size / 3} {
+					buf := make([]byte, entry.Size-offset)
+					n, err := reader.ReadAt(buf, offset)
+					if (err != nil && err != io.EOF) || !bytes.Equal(buf[:n], []byte(content[offset:])) {
+						t.Errorf("reading %s from %d gave %d bytes, %v", name, offset, n, err)
+					}
+				}
+				reader.Close()
+			}
+
+			if archive == "test.zip" {
+				for _, skipped := range []string{"secret: it is encrypted", "bzipped: unsupported compression method 12"} {
+					if !strings.Contains(errorLog, skipped) {
+						t.Errorf("the error log %q does not report %q", errorLog, skipped)
+					}
+				}
+			} else if errorLog != "" {
+				t.Errorf("unexpected errors: %s", errorLog)
+			}
+		})
+	}
+}
+
+func TestListArchiveEntriesFiltered(t *testing.T) {
+	dir := t.TempDir()
+	writeTestZip(t, filepath.Join(dir, "test.zip"))
+	opts := DefaultOptions()
+	opts.OpenArchives = true
+	opts.Include = []string{".txt"}
+	opts.MinSize = 1
+
+	entries, _ := listEntries(t, filepath.Join(dir, "test.zip"), opts)
+	if len(entries) != 2 || entries["a.txt"].Path == "" || entries["docs/b.txt"].Path == "" {
+		t.Errorf("listed %v, want a.txt and docs/b.txt", entries)
+	}
+}
+
+func TestArchiveEstimatedAsEntries(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTar(t, filepath.Join(dir, "test.tar"))
+	writeTestZip(t, filepath.Join(dir, "test.zip"))
+	totalSize := int64(0)
+	for _, content := range archivedFiles {
+		totalSize += int64(len(content))
+	}
+
+	for _, archive := range []string{"test.tar", "test.zip"} {
+		t.Run(archive, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.OpenArchives = true
+			opts.ChunkSize = 4096
+			opts.SampleRatio = 1
+			result, err := EstimateDirectories([]string{filepath.Join(dir, archive)}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.TotalSize != totalSize || result.Files != int64(len(archivedFiles)) {
+				t.Errorf("estimated %d bytes in %d files, want %d in %d", result.TotalSize, result.Files, totalSize, len(archivedFiles))
+			}
+			// The entries are repetitive text, so they compress well, unlike the archive of
+			// deflated entries itself
+			if result.Ratio <= 0 || result.Ratio > 0.5 {
+				t.Errorf("ratio %v, want the ratio of the uncompressed entries", result.Ratio)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package sizer
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+// gitignorePattern is one pattern line of a .gitignore file
+type gitignorePattern struct {
+	matcher *ignore.GitIgnore // Matches the pattern without its leading "!"
+	negate  bool              // The line re-includes what it matches
+}
+
+// gitignoreRules holds the patterns of the .gitignore files found during a walk, keyed by the
+// directory each file is in. A file's patterns match paths relative to its directory
+type gitignoreRules map[string][]gitignorePattern
+
+// Read the .gitignore file of a directory, if it has one
+// Each line is compiled on its own, so that the last matching line can decide as it does in git
+func (r gitignoreRules) load(directory string) error {
+	data, err := os.ReadFile(filepath.Join(directory, ".gitignore"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var patterns []gitignorePattern
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		negate := strings.HasPrefix(line, "!")
+		if negate {
+			line = line[1:]
+		}
+		// A trailing "/**" matches everything inside a directory but not the directory itself,
+		// which the library matches as well unless something has to follow the slash
+		if strings.HasSuffix(line, "/**") {
+			line += "/*"
+		}
+		patterns = append(patterns, gitignorePattern{matcher: ignore.CompileIgnoreLines(line), negate: negate})
+	}
+	r[filepath.Clean(directory)] = patterns
+	return nil
+}
+
+// Check whether git would ignore a path below the scanned directory
+// The .gitignore files of every directory from the scanned one down to the path's parent are
+// consulted in that order, and the last pattern that matches decides, so deeper files override
+// shallower ones. Paths in an ignored directory are never reached, since the walk skips it
+func (r gitignoreRules) ignores(directory, path string, isDir bool) bool {
+	root := filepath.Clean(directory)
+	var parents []string
+	for parent := filepath.Dir(filepath.Clean(path)); ; parent = filepath.Dir(parent) {
+		parents = append(parents, parent)
+		if parent == root || parent == filepath.Dir(parent) {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(parents) - 1; i >= 0; i-- {
+		relativePath, err := filepath.Rel(parents[i], path)
+		if err != nil {
+			continue
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		// Directory patterns such as "build/" only match with the trailing slash
+		if isDir {
+			relativePath += "/"
+		}
+		for _, pattern := range r[parents[i]] {
+			if pattern.matcher.MatchesPath(relativePath) {
+				ignored = !pattern.negate
+			}
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,120 @@
+package sizer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Write the files of a tree, creating the directories they are in
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var gitignoreTree = map[string]string{
+	".gitignore": strings.Join([]string{
+		"# comments and blank lines are skipped",
+		"",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/top.txt",
+		"**/cache/**",
+		"docs/**/*.tmp",
+	}, "\n"),
+	"sub/.gitignore": "!*.log\nlocal.txt\n",
+}
+
+func TestGitignoreRules(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, gitignoreTree)
+	rules := make(gitignoreRules)
+	for _, directory := range []string{root, filepath.Join(root, "sub")} {
+		if err := rules.load(directory); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"dir/a.log", false, true},
+		// Negation re-includes, and a deeper .gitignore overrides a shallower one
+		{"keep.log", false, false},
+		{"dir/keep.log", false, false},
+		{"sub/a.log", false, false},
+		// Directory-only patterns match directories at any depth, not files
+		{"build", true, true},
+		{"dir/build", true, true},
+		{"build", false, false},
+		// Anchored patterns only match next to the .gitignore
+		{"top.txt", false, true},
+		{"dir/top.txt", false, false},
+		// ** matches any number of directories, none included
+		{"cache/x", false, true},
+		{"a/b/cache/x", false, true},
+		{"cache/a/b/x", false, true},
+		{"a/cache", false, false},
+		{"docs/x.tmp", false, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"other/x.tmp", false, false},
+		// The patterns of a nested .gitignore only apply to its own subtree
+		{"sub/local.txt", false, true},
+		{"sub/deeper/local.txt", false, true},
+		{"local.txt", false, false},
+		{"plain.txt", false, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(root, filepath.FromSlash(test.path))
+		if got := rules.ignores(root, path, test.isDir); got != test.ignored {
+			t.Errorf("ignores(%q, isDir %v) = %v, want %v", test.path, test.isDir, got, test.ignored)
+		}
+	}
+}
+
+func TestGitignoreWalk(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, gitignoreTree)
+	writeTree(t, root, map[string]string{
+		"a.log": "x", "keep.log": "x", "top.txt": "x", "plain.txt": "x",
+		"build/out.o": "x", "dir/build/out.o": "x",
+		"docs/a/x.tmp": "x", "docs/a/x.md": "x",
+		"sub/a.log": "x", "sub/local.txt": "x", "sub/top.txt": "x",
+		".git/HEAD": "x",
+	})
+
+	for _, concurrent := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.Gitignore = true
+		opts.ConcurrentWalk = concurrent
+		fileInfoChan := make(chan FileInfo)
+		go listFilesWithSizes(context.Background(), root, opts.filter(), nil, fileInfoChan)
+
+		var paths []string
+		for _, file := range collect(fileInfoChan) {
+			path, _ := filepath.Rel(root, file.Path)
+			paths = append(paths, filepath.ToSlash(path))
+		}
+		slices.Sort(paths)
+		// The .gitignore files are listed like any other file; .git is always skipped
+		want := []string{".gitignore", "docs/a/x.md", "keep.log", "plain.txt", "sub/.gitignore", "sub/a.log", "sub/top.txt"}
+		if !slices.Equal(paths, want) {
+			t.Errorf("concurrent %v: listed %v, want %v", concurrent, paths, want)
+		}
+	}
+}
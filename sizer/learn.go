@@ -0,0 +1,277 @@
+package sizer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LearnedRatio is the average compression ratio sampled for one file extension across runs
+type LearnedRatio struct {
+	Ratio        float64 `json:"ratio"`
+	SampledBytes int64   `json:"sampled_bytes"`
+}
+
+// extensionLearner compresses the sampled bytes of each file extension separately, to learn
+// the typical compression ratio of every extension
+// At most MAX_LEARNING_ENCODERS compressors are open at once: when another is needed, the one
+// least recently written to is closed, and its extension starts a new one if it comes back
+type extensionLearner struct {
+	compressionLevel     int
+	compressionAlgorithm string
+	extensions           map[string]*extensionSample
+	open                 int   // Extensions with an open compressor
+	writes               int64 // Writes so far, to tell which compressor was used least recently
+}
+
+type extensionSample struct {
+	writer           io.WriteCloser // nil while closed to make room for other extensions
+	compressed       *countingWriter
+	compressedSize   int64 // Output of the compressors closed so far
+	uncompressedSize int64
+	lastWrite        int64
+}
+
+func newExtensionLearner(compressionLevel int, compressionAlgorithm string) *extensionLearner {
+	return &extensionLearner{
+		compressionLevel:     compressionLevel,
+		compressionAlgorithm: compressionAlgorithm,
+		extensions:           make(map[string]*extensionSample),
+	}
+}
+
+// File extensions are compared case-insensitively
+func fileExtension(path string) string {
+	return strings.ToLower(filepath.Ext(path))
+}
+
+// Feed sampled bytes to the compressor of the file's extension; this is a sampleObserver
+func (l *extensionLearner) observe(file FileInfo, data []byte) error {
+	extension := fileExtension(file.Path)
+	sample, ok := l.extensions[extension]
+	if !ok {
+		sample = &extensionSample{}
+		l.extensions[extension] = sample
+	}
+	if sample.writer == nil {
+		if l.open >= MAX_LEARNING_ENCODERS {
+			if err := l.closeLeastRecent(); err != nil {
+				return err
+			}
+		}
+		counter := &countingWriter{}
+		writer, err := newCompressionWriter(counter, l.compressionLevel, l.compressionAlgorithm, nil)
+		if err != nil {
+			return err
+		}
+		sample.writer, sample.compressed = writer, counter
+		l.open++
+	}
+	l.writes++
+	sample.lastWrite = l.writes
+	sample.uncompressedSize += int64(len(data))
+	_, err := sample.writer.Write(data)
+	return err
+}
+
+// Close the open compressor least recently written to, keeping the size of its output
+func (l *extensionLearner) closeLeastRecent() error {
+	var leastRecent *extensionSample
+	for _, sample := range l.extensions {
+		if sample.writer != nil && (leastRecent == nil || sample.lastWrite < leastRecent.lastWrite) {
+			leastRecent = sample
+		}
+	}
+	return l.close(leastRecent)
+}
+
+func (l *extensionLearner) close(sample *extensionSample) error {
+	if err := sample.writer.Close(); err != nil {
+		return err
+	}
+	sample.compressedSize += sample.compressed.n
+	sample.writer, sample.compressed = nil, nil
+	l.open--
+	return nil
+}
+
+// Finish compressing and return the ratio sampled for each extension
+func (l *extensionLearner) ratios() (map[string]LearnedRatio, error) {
+	ratios := make(map[string]LearnedRatio, len(l.extensions))
+	for extension, sample := range l.extensions {
+		if sample.writer != nil {
+			if err := l.close(sample); err != nil {
+				return nil, err
+			}
+		}
+		ratios[extension] = LearnedRatio{
+			Ratio:        float64(sample.compressedSize) / float64(sample.uncompressedSize),
+			SampledBytes: sample.uncompressedSize,
+		}
+	}
+	return ratios, nil
+}
+
+// storageClassifier decides file by file whether an archiver would compress each file or
+// store it as is because compressing it does not make it any smaller, as zip does
+// The sampled bytes of each file are compressed on their own to make that decision
+type storageClassifier struct {
+	compressionLevel     int
+	compressionAlgorithm string
+
+	current          string
+	writer           io.WriteCloser
+	compressed       *countingWriter
+	uncompressedSize int64
+
+	storedBytes     int64 // Sampled bytes of files that would be stored
+	compressedBytes int64 // Sampled bytes of files that would be compressed
+}
+
+func newStorageClassifier(compressionLevel int, compressionAlgorithm string) *storageClassifier {
+	return &storageClassifier{compressionLevel: compressionLevel, compressionAlgorithm: compressionAlgorithm}
+}
+
+// Feed sampled bytes to the compressor of the current file; this is a sampleObserver
+// Files arrive one after the other, so a new path means the previous file is complete
+func (c *storageClassifier) observe(file FileInfo, data []byte) error {
+	if file.Path != c.current {
+		if err := c.finish(); err != nil {
+			return err
+		}
+		c.compressed = &countingWriter{}
+		writer, err := newCompressionWriter(c.compressed, c.compressionLevel, c.compressionAlgorithm, nil)
+		if err != nil {
+			return err
+		}
+		c.current = file.Path
+		c.writer = writer
+		c.uncompressedSize = 0
+	}
+	c.uncompressedSize += int64(len(data))
+	_, err := c.writer.Write(data)
+	return err
+}
+
+// Classify the current file, if any
+func (c *storageClassifier) finish() error {
+	if c.writer == nil {
+		return nil
+	}
+	if err := c.writer.Close(); err != nil {
+		return err
+	}
+	if c.compressed.n >= c.uncompressedSize {
+		c.storedBytes += c.uncompressedSize
+	} else {
+		c.compressedBytes += c.uncompressedSize
+	}
+	c.writer = nil
+	return nil
+}
+
+// Fraction of the sampled bytes that came from files that would be stored
+func (c *storageClassifier) storedFraction() (float64, error) {
+	if err := c.finish(); err != nil {
+		return 0, err
+	}
+	sampledBytes := c.storedBytes + c.compressedBytes
+	if sampledBytes == 0 {
+		return 0, nil
+	}
+	return float64(c.storedBytes) / float64(sampledBytes), nil
+}
+
+// Load path hints from a JSON file
+// The file is an object mapping path prefixes, relative to the scanned directory and using
+// forward slashes, to the compression ratio to assume for files under them, e.g.
+// {"vault/": 1.0, "logs/archive/": 0.1}
+func LoadHints(path string) (map[string]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var hints map[string]float64
+	if err := json.Unmarshal(data, &hints); err != nil {
+		return nil, err
+	}
+	for prefix, ratio := range hints {
+		if ratio <= 0 {
+			return nil, fmt.Errorf("ratio for '%s' must be positive", prefix)
+		}
+	}
+	return hints, nil
+}
+
+// Look up the ratio hinted for a file; the longest matching prefix wins
+func hintedRatio(hints map[string]float64, directory, path string) (float64, bool) {
+	if len(hints) == 0 {
+		return 0, false
+	}
+	relativePath, err := filepath.Rel(directory, path)
+	if err != nil {
+		return 0, false
+	}
+	relativePath = filepath.ToSlash(relativePath)
+
+	ratio, longest := float64(0), -1
+	for prefix, prefixRatio := range hints {
+		if len(prefix) > longest && strings.HasPrefix(relativePath, prefix) {
+			ratio, longest = prefixRatio, len(prefix)
+		}
+	}
+	return ratio, longest >= 0
+}
+
+// The learned ratio store holds one table of extensions per algorithm and level, since a
+// ratio means nothing outside the settings it was measured with
+func LearnedRatioKey(compressionLevel int, compressionAlgorithm string) string {
+	return fmt.Sprintf("%s-%d", compressionAlgorithm, compressionLevel)
+}
+
+// Load the learned ratio store; a missing file is an empty store
+func LoadLearnedRatios(path string) (map[string]map[string]LearnedRatio, error) {
+	store := make(map[string]map[string]LearnedRatio)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Merge the ratios sampled in this run into the learned table, weighting each extension's
+// average by the number of bytes sampled for it
+func mergeLearnedRatios(learned, sampled map[string]LearnedRatio) {
+	for extension, ratio := range sampled {
+		previous, ok := learned[extension]
+		if !ok {
+			learned[extension] = ratio
+			continue
+		}
+		sampledBytes := previous.SampledBytes + ratio.SampledBytes
+		learned[extension] = LearnedRatio{
+			Ratio:        (previous.Ratio*float64(previous.SampledBytes) + ratio.Ratio*float64(ratio.SampledBytes)) / float64(sampledBytes),
+			SampledBytes: sampledBytes,
+		}
+	}
+}
+
+// Write the learned ratio store back to disk
+func SaveLearnedRatios(path string, store map[string]map[string]LearnedRatio) error {
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,176 @@
+package sizer
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLearnedRatiosRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "learned.json")
+	store, err := LoadLearnedRatios(path)
+	if err != nil || len(store) != 0 {
+		t.Fatalf("loading a store that does not exist gave %v, %v, want an empty store", store, err)
+	}
+
+	store[LearnedRatioKey(6, "gzip")] = map[string]LearnedRatio{
+		".txt": {Ratio: 0.25, SampledBytes: 1 << 20},
+		"":     {Ratio: 0.5, SampledBytes: 10},
+	}
+	store[LearnedRatioKey(3, "zstd")] = map[string]LearnedRatio{".jpg": {Ratio: 1.01, SampledBytes: 4096}}
+	if err := SaveLearnedRatios(path, store); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadLearnedRatios(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, store) {
+		t.Errorf("loaded %v, want %v", loaded, store)
+	}
+}
+
+func TestMergeLearnedRatios(t *testing.T) {
+	learned := map[string]LearnedRatio{".txt": {Ratio: 0.2, SampledBytes: 300}}
+	mergeLearnedRatios(learned, map[string]LearnedRatio{
+		".txt": {Ratio: 0.6, SampledBytes: 100},
+		".bin": {Ratio: 0.9, SampledBytes: 50},
+	})
+	// Each extension's ratio is averaged over the bytes sampled for it
+	want := map[string]LearnedRatio{
+		".txt": {Ratio: 0.3, SampledBytes: 400},
+		".bin": {Ratio: 0.9, SampledBytes: 50},
+	}
+	for extension, ratio := range want {
+		got := learned[extension]
+		if got.SampledBytes != ratio.SampledBytes || got.Ratio < ratio.Ratio-1e-9 || got.Ratio > ratio.Ratio+1e-9 {
+			t.Errorf("%s merged to %+v, want %+v", extension, got, ratio)
+		}
+	}
+}
+
+func TestExtensionLearner(t *testing.T) {
+	learner := newExtensionLearner(COMPRESSION_LEVEL, "gzip")
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000))
+	random := make([]byte, 32<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	// Extensions are compared case-insensitively, and every file of one adds to its sample
+	for _, sample := range []struct {
+		path string
+		data []byte
+	}{{"a.txt", text}, {"dir/B.TXT", text}, {"c.bin", random}, {"noextension", text[:100]}} {
+		if err := learner.observe(FileInfo{Path: sample.path}, sample.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ratios, err := learner.ratios()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ratios) != 3 {
+		t.Errorf("learned %v, want the extensions .txt, .bin and none", ratios)
+	}
+	if ratio := ratios[".txt"]; ratio.SampledBytes != int64(2*len(text)) || ratio.Ratio <= 0 || ratio.Ratio > 0.1 {
+		t.Errorf(".txt learned %+v, want a small ratio over %d bytes", ratio, 2*len(text))
+	}
+	if ratio := ratios[".bin"]; ratio.SampledBytes != int64(len(random)) || ratio.Ratio < 1 {
+		t.Errorf(".bin learned %+v, want a ratio of at least 1 over %d bytes", ratio, len(random))
+	}
+	if ratio := ratios[""]; ratio.SampledBytes != 100 {
+		t.Errorf("files without an extension learned %+v, want 100 bytes", ratio)
+	}
+}
+
+func TestExtensionLearnerLimitsOpenCompressors(t *testing.T) {
+	learner := newExtensionLearner(COMPRESSION_LEVEL, "gzip")
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 100))
+	// Twice as many extensions as compressors may be open, each seen twice in turn, so that
+	// every compressor is closed before its extension comes back
+	extensions := 2 * MAX_LEARNING_ENCODERS
+	for round := 0; round < 2; round++ {
+		for i := 0; i < extensions; i++ {
+			if err := learner.observe(FileInfo{Path: fmt.Sprintf("file.ext%d", i)}, text); err != nil {
+				t.Fatal(err)
+			}
+			if learner.open > MAX_LEARNING_ENCODERS {
+				t.Fatalf("%d compressors open, want at most %d", learner.open, MAX_LEARNING_ENCODERS)
+			}
+		}
+	}
+	ratios, err := learner.ratios()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ratios) != extensions {
+		t.Fatalf("learned %d extensions, want %d", len(ratios), extensions)
+	}
+	// Each extension was compressed as two separate streams, each at the ratio of the text alone
+	want := float64(len(compressBuffer(t, text, COMPRESSION_LEVEL, "gzip"))) / float64(len(text))
+	for extension, ratio := range ratios {
+		if ratio.SampledBytes != int64(2*len(text)) || math.Abs(ratio.Ratio-want) > 1e-9 {
+			t.Errorf("%s learned %+v, want a ratio of %v over %d bytes", extension, ratio, want, 2*len(text))
+		}
+	}
+	if learner.open != 0 {
+		t.Errorf("%d compressors left open", learner.open)
+	}
+}
+
+func TestUseLearnedSkipsSampling(t *testing.T) {
+	dir := t.TempDir()
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 2000)
+	data := strings.Repeat("0123456789abcdef", 4096)
+	writeTree(t, dir, map[string]string{"a.txt": text, "sub/b.TXT": text, "c.dat": data})
+
+	for _, useLearned := range []bool{false, true} {
+		learned := map[string]LearnedRatio{".txt": {Ratio: 0.25, SampledBytes: 1000}}
+		var dump bytes.Buffer
+		opts := DefaultOptions()
+		opts.SampleRatio = 1
+		opts.ChunkSize = 4096
+		opts.Learned = learned
+		opts.UseLearned = useLearned
+		opts.DumpSample = &dump
+		result, err := EstimateDirectories([]string{dir}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		totalSize := int64(2*len(text) + len(data))
+		if result.TotalSize != totalSize || result.Files != 3 {
+			t.Errorf("useLearned %v: estimated %d bytes in %d files, want %d in 3", useLearned, result.TotalSize, result.Files, totalSize)
+		}
+		if !useLearned {
+			// Every file is sampled, and the ratio sampled for .txt is merged into the store
+			if dump.Len() != int(totalSize) {
+				t.Errorf("sampled %d bytes, want all %d", dump.Len(), totalSize)
+			}
+			if learned[".txt"].SampledBytes != 1000+int64(2*len(text)) {
+				t.Errorf(".txt was not learned from: %+v", learned[".txt"])
+			}
+			continue
+		}
+
+		// The .txt files take the learned ratio and are never read, so only c.dat is
+		// sampled and learned from
+		if dump.String() != data {
+			t.Errorf("sampled %d bytes, want only the %d of c.dat", dump.Len(), len(data))
+		}
+		if learned[".txt"] != (LearnedRatio{Ratio: 0.25, SampledBytes: 1000}) {
+			t.Errorf("the learned ratio of .txt changed to %+v", learned[".txt"])
+		}
+		if learned[".dat"].SampledBytes != int64(len(data)) {
+			t.Errorf(".dat learned %+v, want %d bytes", learned[".dat"], len(data))
+		}
+		datCompressedSize := float64(result.EstimatedCompressedSize) - 0.25*float64(2*len(text))
+		if datCompressedSize <= 0 || datCompressedSize > float64(len(data))/2 {
+			t.Errorf("estimated %d bytes, want a quarter of the .txt files plus c.dat compressed", result.EstimatedCompressedSize)
+		}
+	}
+}
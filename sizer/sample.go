@@ -0,0 +1,779 @@
+package sizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// SampleWindow is a byte range of the concatenated file stream to sample
+type SampleWindow struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// Supported sampling modes
+// streaming takes a sample from every chunk of the file stream as it is listed, in one pass.
+// stratified lists the files first to learn the size of the stream, then cuts all of it into
+// equal strata and samples each, so the end of the stream is sampled as densely as the rest.
+// contiguous lists the files first as well, then takes the whole sample as one run of the
+// stream, as cat * | gzip would see it, without breaks between samples
+var SamplingModes = []string{"streaming", "stratified", "contiguous"}
+
+// Matches file names that differ only in a version number, e.g. foo.1, foo-2.csv, foo_3
+var versionedNameRegex = regexp.MustCompile(`^(.*?)[._-]?\d+(\.[^.]*)?$`)
+
+// deltaFilter models delta-compressed storage of versioned files
+// Files whose names differ only in a version number form a group, and each file is
+// XOR-deltaed against the previous file of its group (in walk order) before compression
+type deltaFilter struct {
+	latest map[string]string // group key -> path of the most recent file seen
+}
+
+func newDeltaFilter() *deltaFilter {
+	return &deltaFilter{latest: make(map[string]string)}
+}
+
+// Record path as the latest version of its group and return the previous version, if any
+// Every file must be recorded, even those that end up not being sampled
+func (d *deltaFilter) predecessor(path string) string {
+	match := versionedNameRegex.FindStringSubmatch(filepath.Base(path))
+	if match == nil || match[1] == "" {
+		return ""
+	}
+	group := filepath.Join(filepath.Dir(path), match[1]+match[2])
+
+	previous := d.latest[group]
+	d.latest[group] = path
+	return previous
+}
+
+// XOR buf, which was read at offset of a file, with the same byte range of its predecessor
+// Bytes past the end of the predecessor are left untouched, as is buf if it cannot be read
+func xorWithPredecessor(buf []byte, predecessor string, offset int64) {
+	f, err := os.Open(predecessor)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	previous := make([]byte, len(buf))
+	n, _ := f.ReadAt(previous, offset)
+	for i := 0; i < n; i++ {
+		buf[i] ^= previous[i]
+	}
+}
+
+// sampleObserver is handed every sampled byte along with the file it was read from
+type sampleObserver func(file FileInfo, data []byte) error
+
+// observerWriter adapts a sampleObserver for one file to an io.Writer
+type observerWriter struct {
+	file    FileInfo
+	observe sampleObserver
+}
+
+func (w observerWriter) Write(p []byte) (int, error) {
+	if err := w.observe(w.file, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Combine several observers into one; nil observers are left out
+func combineObservers(observers ...sampleObserver) sampleObserver {
+	var combined []sampleObserver
+	for _, observe := range observers {
+		if observe != nil {
+			combined = append(combined, observe)
+		}
+	}
+	if len(combined) == 0 {
+		return nil
+	}
+	return func(file FileInfo, data []byte) error {
+		for _, observe := range combined {
+			if err := observe(file, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// assumedTotals adds up the files whose ratio was assumed rather than sampled
+type assumedTotals struct {
+	size           int64
+	files          int64
+	compressedSize float64 // Estimated compressed size of the files
+	storedSize     float64 // Part of compressedSize from files assumed not to compress at all (ratio 1 or more)
+	belowThreshold int64   // Files assumed to be stored because they are below the compression threshold
+
+	// Every file listed, sampled or assumed, added up by extension if not nil
+	extensions map[string]*extensionTotals
+}
+
+// extensionTotals adds up the files of one extension
+type extensionTotals struct {
+	sampledSize           int64   // Bytes in the files passed on to be sampled
+	assumedSize           int64   // Bytes in the files whose ratio was assumed
+	assumedCompressedSize float64 // Estimated compressed size of those
+}
+
+// Take files whose compression ratio is already known out of the stream to be sampled
+// ratioFor returns the assumed ratio of a file, if it has one. Those files are added to
+// assumed instead of being sampled; all other files are passed on. If assumed.extensions is not
+// nil, both kinds are added up by extension there as well
+// The totals are complete once the returned channel has been closed
+func assumeRatios(ctx context.Context, fileInfoChan <-chan FileInfo, assumed *assumedTotals, ratioFor func(FileInfo) (float64, bool)) <-chan FileInfo {
+	sampledFileChan := make(chan FileInfo)
+
+	go func() {
+		defer close(sampledFileChan)
+
+		for file, ok := nextFile(ctx, fileInfoChan); ok; file, ok = nextFile(ctx, fileInfoChan) {
+			// Tar headers and padding are always sampled along with the files
+			if file.data != nil {
+				if !sendFile(ctx, sampledFileChan, file) {
+					return
+				}
+				continue
+			}
+
+			var extension *extensionTotals
+			if assumed.extensions != nil {
+				key := fileExtension(file.Path)
+				if extension = assumed.extensions[key]; extension == nil {
+					extension = &extensionTotals{}
+					assumed.extensions[key] = extension
+				}
+			}
+
+			if ratio, ok := ratioFor(file); ok {
+				assumed.size += file.Size
+				assumed.files++
+				assumed.compressedSize += float64(file.Size) * ratio
+				if ratio >= 1 {
+					assumed.storedSize += float64(file.Size) * ratio
+				}
+				if extension != nil {
+					extension.assumedSize += file.Size
+					extension.assumedCompressedSize += float64(file.Size) * ratio
+				}
+				continue
+			}
+			if extension != nil {
+				extension.sampledSize += file.Size
+			}
+			if !sendFile(ctx, sampledFileChan, file) {
+				return
+			}
+		}
+	}()
+
+	return sampledFileChan
+}
+
+// streamTotals adds up all the files listed into a sampled stream, sampled or not
+type streamTotals struct {
+	size    int64
+	files   int64
+	partial bool // The context was done before the listing was, so only the files listed by then are counted
+
+	// What was actually read for the samples, for verbose output
+	samplePoints int64
+	sampledFiles int64
+	sampledBytes int64
+}
+
+// sampledStream is the read end of the sampled data pipe
+// Closing it early stops the sampling, but the remaining files are still walked so that
+// the totals stay correct; Close waits for that to finish
+type sampledStream struct {
+	io.Reader // The pipe, or a copy of it with teeTo
+	pipe      *io.PipeReader
+	done      chan struct{}
+	totals    streamTotals // Only written by the sampling goroutine, until done is closed
+}
+
+func newSampledStream() (*sampledStream, *io.PipeWriter) {
+	sampledDataPipe, sampledDataWriter := io.Pipe()
+	return &sampledStream{Reader: sampledDataPipe, pipe: sampledDataPipe, done: make(chan struct{})}, sampledDataWriter
+}
+
+func (s *sampledStream) Close() error {
+	err := s.pipe.Close()
+	<-s.done
+	return err
+}
+
+// Copy the sampled data to w as it is read, to inspect what the estimate was made from
+// Only what is read is copied, so a stream closed early leaves the rest out
+func (s *sampledStream) teeTo(w io.Writer) {
+	s.Reader = io.TeeReader(s.pipe, w)
+}
+
+// Stop reading the stream and return the totals of every listed file
+// This waits for the rest of the listing to be walked
+func (s *sampledStream) finish() streamTotals {
+	s.Close()
+	return s.totals
+}
+
+// sampleBuffer holds the samples so that they can be read from the start any number of times
+// They are kept in memory up to memoryLimit bytes (0 for no limit); past that, everything is
+// moved to a temporary file, which Close removes
+type sampleBuffer struct {
+	memoryLimit int64
+	memory      []byte
+	file        *os.File
+	size        int64
+}
+
+func (b *sampleBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.memoryLimit > 0 && b.size+int64(len(p)) > b.memoryLimit {
+		file, err := os.CreateTemp("", "zip-sizer-samples-*")
+		if err != nil {
+			return 0, err
+		}
+		b.file = file
+		if _, err := file.Write(b.memory); err != nil {
+			return 0, err
+		}
+		b.memory = nil
+	}
+	if b.file == nil {
+		b.memory = append(b.memory, p...)
+		b.size += int64(len(p))
+		return len(p), nil
+	}
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// A reader of the samples from the first byte; every call starts again from there
+func (b *sampleBuffer) reader() io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.memory)
+}
+
+// Remove the temporary file, if the samples were moved to one
+func (b *sampleBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// Sample sampleSize bytes from every chunkSize from the concatenated file stream
+// The basic idea is to pretend the files are a single large file and sample data from it
+// at regular intervals. This is done by calculating the offsets of the sampled data in the
+// concatenated file and then reading the data from the original files at those offsets.
+// Extract sampled data from the original files and write it to a pipe
+// This allows us to stream the sampled data without loading all files into memory at once
+// With a delta filter, sampled bytes are XOR-deltaed against the file's previous version
+// If observe is not nil it is handed every sampled byte as well
+// If jitter is not nil each sample is taken at a random position within its chunk rather than
+// at the chunk's end, so that the samples do not line up with regularly sized files
+// A sample that reaches the end of a file carries on into the next ones until sampleSize bytes
+// are read, so that directories of files smaller than a sample are sampled as densely as any other
+// Once ctx is done no more files are taken in, and the stream ends with what was sampled
+// Files that cannot be read, such as those removed since they were listed, are reported to
+// errorLog and their samples skipped; they still count towards the totals at their listed size
+// A read that fails is retried readRetries times first, so that a transient error does not
+// cost the rest of the file's samples
+func streamSampledData(ctx context.Context, fileInfoChan <-chan FileInfo, chunkSize, sampleSize int64, jitter *rand.Rand, delta *deltaFilter, observe sampleObserver, readRetries int, errorLog io.Writer, verbose bool) (*sampledStream, error) {
+	stream, sampledDataWriter := newSampledStream()
+
+	go func() {
+		defer close(stream.done)
+		defer sampledDataWriter.Close()
+
+		currentOffset := int64(0)
+		sampling := true
+
+		// The sample point of the chunk starting at chunkStart
+		samplePoint := func(chunkStart int64) int64 {
+			if jitter == nil {
+				return chunkStart + chunkSize - sampleSize
+			}
+			return chunkStart + jitter.Int63n(chunkSize-sampleSize+1)
+		}
+		chunkStart := int64(0)
+		nextSamplePoint := samplePoint(chunkStart) // Next byte of the current sample still to be read
+		sampleEnd := nextSamplePoint + sampleSize
+
+		// Move on to readEnd, and to the next chunk's sample once the current one is read up to its end
+		advance := func(readEnd int64) {
+			nextSamplePoint = readEnd
+			if readEnd == sampleEnd {
+				chunkStart += chunkSize
+				nextSamplePoint = samplePoint(chunkStart)
+				sampleEnd = nextSamplePoint + sampleSize
+			}
+		}
+		// Move past the samples, or parts of them, before end without reading them
+		// The samples of the chunks before the one end lies in all end before it, so those
+		// chunks are jumped over at once, and skipping even a huge file takes no time
+		skipSamples := func(end int64) {
+			if chunk := end - end%chunkSize; chunkStart < chunk {
+				chunkStart = chunk
+				nextSamplePoint = samplePoint(chunkStart)
+				sampleEnd = nextSamplePoint + sampleSize
+			}
+			for nextSamplePoint < end {
+				advance(min(sampleEnd, end))
+			}
+		}
+
+		for file, ok := nextFile(ctx, fileInfoChan); ok; file, ok = nextFile(ctx, fileInfoChan) {
+			stream.totals.size += file.Size
+			if file.data == nil {
+				stream.totals.files++
+			}
+			fileEnd := currentOffset + file.Size
+
+			predecessor := ""
+			if delta != nil && file.data == nil {
+				predecessor = delta.predecessor(file.Path)
+			}
+
+			if !sampling || nextSamplePoint >= fileEnd {
+				currentOffset = fileEnd
+				continue
+			}
+
+			// If verbose, log the file being processed
+			if verbose && file.data == nil {
+				log.Printf("Sampling file: %s", file.Path)
+			}
+			f, err := openSampled(file, readRetries)
+			if err != nil {
+				fmt.Fprintf(errorLog, "Error opening file %s, skipping it: %v\n", file.Path, err)
+				skipSamples(fileEnd)
+				currentOffset = fileEnd
+				continue
+			}
+			if file.data == nil {
+				stream.totals.sampledFiles++
+			}
+
+			for nextSamplePoint < fileEnd {
+				relativeOffset := nextSamplePoint - currentOffset
+				readEnd := min(sampleEnd, fileEnd)
+
+				// A file truncated since it was listed, or smaller than a size index claims, reads
+				// short or not at all, and the rest of it is skipped below
+				buf := make([]byte, readEnd-nextSamplePoint)
+				n, err := f.ReadAt(buf, relativeOffset)
+				if err != nil && err != io.EOF {
+					fmt.Fprintf(errorLog, "Error reading file %s, skipping the rest of it: %v\n", file.Path, err)
+					skipSamples(fileEnd)
+					break
+				}
+
+				if n > 0 {
+					if nextSamplePoint == sampleEnd-sampleSize {
+						stream.totals.samplePoints++
+					}
+					stream.totals.sampledBytes += int64(n)
+					if predecessor != "" {
+						xorWithPredecessor(buf[:n], predecessor, relativeOffset)
+					}
+					if observe != nil {
+						if err := observe(file, buf[:n]); err != nil {
+							f.Close()
+							sampledDataWriter.CloseWithError(err)
+							return
+						}
+					}
+					if err := writeFull(sampledDataWriter, buf[:n]); err != nil {
+						// The reader has stopped early (adaptive sampling); keep totaling sizes only
+						if err == io.ErrClosedPipe {
+							sampling = false
+							break
+						}
+						f.Close()
+						sampledDataWriter.CloseWithError(err)
+						return
+					}
+				}
+
+				if n < len(buf) {
+					fmt.Fprintf(errorLog, "File %s is shorter than it was listed as, skipping the rest of it\n", file.Path)
+					skipSamples(fileEnd)
+					break
+				}
+				advance(readEnd)
+			}
+
+			f.Close()
+			currentOffset = fileEnd
+		}
+		stream.totals.partial = ctx.Err() != nil
+	}()
+
+	return stream, nil
+}
+
+// Work out the samples streamSampledData would take from the files, without reading them
+// The sample points are computed the same way, so with the same seed the schedule matches
+func scheduleSampledData(fileInfoChan <-chan FileInfo, chunkSize, sampleSize int64, jitter *rand.Rand) SampleSchedule {
+	var schedule SampleSchedule
+	currentOffset := int64(0)
+
+	samplePoint := func(chunkStart int64) int64 {
+		if jitter == nil {
+			return chunkStart + chunkSize - sampleSize
+		}
+		return chunkStart + jitter.Int63n(chunkSize-sampleSize+1)
+	}
+	chunkStart := int64(0)
+	nextSamplePoint := samplePoint(chunkStart)
+	sampleEnd := nextSamplePoint + sampleSize
+
+	for file := range fileInfoChan {
+		schedule.TotalSize += file.Size
+		fileEnd := currentOffset + file.Size
+		if file.data == nil {
+			schedule.Files++
+			if nextSamplePoint < fileEnd {
+				schedule.SampledFiles++
+			}
+		}
+		// A sample carries on into the next file, and is only cut short by the end of the stream
+		for nextSamplePoint < fileEnd {
+			if nextSamplePoint == sampleEnd-sampleSize {
+				schedule.SamplePoints++
+			}
+			readEnd := min(sampleEnd, fileEnd)
+			schedule.SampledBytes += readEnd - nextSamplePoint
+			nextSamplePoint = readEnd
+			if readEnd == sampleEnd {
+				chunkStart += chunkSize
+				nextSamplePoint = samplePoint(chunkStart)
+				sampleEnd = nextSamplePoint + sampleSize
+			}
+		}
+		currentOffset = fileEnd
+	}
+	return schedule
+}
+
+// sampledReader is what samples are read from: a file, or an entry held in memory
+type sampledReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// memoryEntry is an entry of the listing held in memory, read like a file
+type memoryEntry struct {
+	*bytes.Reader
+}
+
+func (memoryEntry) Close() error {
+	return nil
+}
+
+// retryingReader retries the reads of a file that fail other than at its end, up to retries
+// more times, waiting READ_RETRY_DELAY before the first retry and twice as long before each
+// one after it. Only what is still missing is read again, and the last error is returned
+type retryingReader struct {
+	sampledReader
+	retries int
+}
+
+func (r retryingReader) ReadAt(p []byte, off int64) (int, error) {
+	delay := READ_RETRY_DELAY
+	read := 0
+	for attempt := 0; ; attempt++ {
+		n, err := r.sampledReader.ReadAt(p[read:], off+int64(read))
+		read += n
+		if err == nil || err == io.EOF || attempt == r.retries {
+			return read, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Open a listed file for sampling, the contents of an entry that is held in memory, or a file
+// stored in an archive
+// The reads of a file are retried readRetries times when they fail
+func openSampled(file FileInfo, readRetries int) (sampledReader, error) {
+	if file.data != nil {
+		return memoryEntry{bytes.NewReader(file.data)}, nil
+	}
+	if file.open != nil {
+		return file.open()
+	}
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	if readRetries > 0 {
+		return retryingReader{sampledReader: f, retries: readRetries}, nil
+	}
+	return f, nil
+}
+
+// Create the random source that jitters the sample points, or nil for periodic sampling
+// when no seed was given
+func newJitter(seed *int64) *rand.Rand {
+	if seed == nil {
+		return nil
+	}
+	return rand.New(rand.NewSource(*seed))
+}
+
+// Spread sample windows evenly over a stream of streamSize bytes, for stratified sampling
+// The stream is cut into strata of about chunkSize bytes that cover it exactly, and sampleRatio
+// of every stratum is sampled from its middle, or from a random position within it if jitter
+// is not nil. A stream smaller than a chunk is a single stratum, so it is still sampled; as
+// with per-file estimates, at least PER_FILE_MIN_SAMPLE bytes of a stratum are sampled
+func stratifiedPlan(streamSize, chunkSize int64, sampleRatio float64, jitter *rand.Rand) []SampleWindow {
+	if streamSize <= 0 {
+		return nil
+	}
+	strata := max((streamSize+chunkSize/2)/chunkSize, 1)
+
+	plan := make([]SampleWindow, 0, strata)
+	for i := int64(0); i < strata; i++ {
+		// Floating point keeps the products from overflowing on very large streams
+		start := int64(float64(streamSize) * float64(i) / float64(strata))
+		end := int64(float64(streamSize) * float64(i+1) / float64(strata))
+		if i == strata-1 {
+			end = streamSize
+		}
+		length := max(int64(float64(end-start)*sampleRatio), min(end-start, PER_FILE_MIN_SAMPLE))
+		if length <= 0 {
+			continue
+		}
+
+		offset := start + (end-start-length)/2
+		if jitter != nil {
+			offset = start + jitter.Int63n(end-start-length+1)
+		}
+		plan = append(plan, SampleWindow{Offset: offset, Length: length})
+	}
+	return plan
+}
+
+// Take a single window of sampleRatio of a stream of streamSize bytes, for contiguous sampling
+// The window lies in the middle of the stream, or at a random position if jitter is not nil.
+// As with stratified sampling, at least PER_FILE_MIN_SAMPLE bytes are sampled
+func contiguousPlan(streamSize int64, sampleRatio float64, jitter *rand.Rand) []SampleWindow {
+	if streamSize <= 0 {
+		return nil
+	}
+	length := max(int64(float64(streamSize)*sampleRatio), min(streamSize, PER_FILE_MIN_SAMPLE))
+	offset := (streamSize - length) / 2
+	if jitter != nil {
+		offset = jitter.Int63n(streamSize - length + 1)
+	}
+	return []SampleWindow{{Offset: offset, Length: length}}
+}
+
+// Load an explicit sampling plan from a JSON file
+// The plan is a list of {"offset": N, "length": M} windows into the concatenated file stream
+// Windows are sorted by offset and must not overlap, so every byte is sampled at most once
+func LoadSamplePlan(path string) ([]SampleWindow, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan []SampleWindow
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Offset < plan[j].Offset })
+	for i, window := range plan {
+		if window.Offset < 0 || window.Length <= 0 {
+			return nil, fmt.Errorf("window %d has a negative offset or non-positive length", i)
+		}
+		if i > 0 && plan[i-1].Offset+plan[i-1].Length > window.Offset {
+			return nil, fmt.Errorf("window at offset %d overlaps the previous window", window.Offset)
+		}
+	}
+	return plan, nil
+}
+
+// Sample exactly the byte ranges listed in the plan from the concatenated file stream
+// This works like streamSampledData, but the offsets come from the plan instead of being
+// computed from a chunk size. A window may span several files, in which case it is read
+// from each of them in turn. Windows beyond the end of the stream are ignored
+// If observe is not nil it is handed every sampled byte as well
+// Once ctx is done no more files are taken in, and the stream ends with what was sampled
+// Files that cannot be read, even after readRetries retries, are reported to errorLog and
+// skipped, as in streamSampledData
+func streamPlannedData(ctx context.Context, fileInfoChan <-chan FileInfo, plan []SampleWindow, observe sampleObserver, readRetries int, errorLog io.Writer, verbose bool) (*sampledStream, error) {
+	stream, sampledDataWriter := newSampledStream()
+
+	go func() {
+		defer close(stream.done)
+		defer sampledDataWriter.Close()
+
+		currentOffset := int64(0)
+		windowIndex := 0
+		nextSamplePoint := int64(0) // Next byte of the current window still to be read
+		if len(plan) > 0 {
+			nextSamplePoint = plan[0].Offset
+		}
+		sampling := true
+
+		// Move on to readEnd, and to the next window once the current one is read up to its end
+		advance := func(readEnd int64) {
+			nextSamplePoint = readEnd
+			if readEnd == plan[windowIndex].Offset+plan[windowIndex].Length {
+				windowIndex++
+				if windowIndex < len(plan) {
+					nextSamplePoint = plan[windowIndex].Offset
+				}
+			}
+		}
+		// Move past the windows, or parts of them, before end without reading them
+		skipWindows := func(end int64) {
+			for windowIndex < len(plan) && nextSamplePoint < end {
+				advance(min(plan[windowIndex].Offset+plan[windowIndex].Length, end))
+			}
+		}
+
+		for file, ok := nextFile(ctx, fileInfoChan); ok; file, ok = nextFile(ctx, fileInfoChan) {
+			stream.totals.size += file.Size
+			if file.data == nil {
+				stream.totals.files++
+			}
+			fileEnd := currentOffset + file.Size
+
+			if !sampling || windowIndex >= len(plan) || nextSamplePoint >= fileEnd {
+				currentOffset = fileEnd
+				continue
+			}
+
+			if verbose && file.data == nil {
+				log.Printf("Sampling file: %s", file.Path)
+			}
+			f, err := openSampled(file, readRetries)
+			if err != nil {
+				fmt.Fprintf(errorLog, "Error opening file %s, skipping it: %v\n", file.Path, err)
+				skipWindows(fileEnd)
+				currentOffset = fileEnd
+				continue
+			}
+			if file.data == nil {
+				stream.totals.sampledFiles++
+			}
+
+			var writer io.Writer = sampledDataWriter
+			if observe != nil {
+				writer = io.MultiWriter(sampledDataWriter, observerWriter{file: file, observe: observe})
+			}
+
+			for windowIndex < len(plan) && nextSamplePoint < fileEnd {
+				windowEnd := plan[windowIndex].Offset + plan[windowIndex].Length
+				readEnd := min(windowEnd, fileEnd)
+				length := readEnd - nextSamplePoint
+				if nextSamplePoint == plan[windowIndex].Offset {
+					stream.totals.samplePoints++
+				}
+
+				// A file truncated since it was listed, or smaller than a size index claims, reads
+				// short or not at all, and the rest of it is skipped
+				section := io.NewSectionReader(f, nextSamplePoint-currentOffset, length)
+				copied, err := io.CopyN(writer, section, length)
+				stream.totals.sampledBytes += copied
+				if err == io.EOF {
+					skipWindows(fileEnd)
+					break
+				}
+				if err != nil {
+					// The reader has stopped early (adaptive sampling); keep totaling sizes only
+					if errors.Is(err, io.ErrClosedPipe) {
+						sampling = false
+						break
+					}
+					// An observer failing is fatal, while a file failing to read is skipped
+					var readErr *fs.PathError
+					if !errors.As(err, &readErr) {
+						f.Close()
+						sampledDataWriter.CloseWithError(err)
+						return
+					}
+					fmt.Fprintf(errorLog, "Error reading file %s, skipping the rest of it: %v\n", file.Path, err)
+					skipWindows(fileEnd)
+					break
+				}
+
+				advance(readEnd)
+			}
+
+			f.Close()
+			currentOffset = fileEnd
+		}
+		stream.totals.partial = ctx.Err() != nil
+	}()
+
+	return stream, nil
+}
+
+// Work out the samples streamPlannedData would take from the files, without reading them
+// Windows that start beyond the end of the stream are not counted, and a window that runs past
+// it is counted with only the bytes that are there
+func schedulePlannedData(fileInfoChan <-chan FileInfo, plan []SampleWindow) SampleSchedule {
+	var schedule SampleSchedule
+	currentOffset := int64(0)
+	windowIndex := 0
+	nextSamplePoint := int64(0)
+	if len(plan) > 0 {
+		nextSamplePoint = plan[0].Offset
+	}
+
+	for file := range fileInfoChan {
+		schedule.TotalSize += file.Size
+		fileEnd := currentOffset + file.Size
+		if file.data == nil {
+			schedule.Files++
+			if windowIndex < len(plan) && nextSamplePoint < fileEnd {
+				schedule.SampledFiles++
+			}
+		}
+		for windowIndex < len(plan) && nextSamplePoint < fileEnd {
+			windowEnd := plan[windowIndex].Offset + plan[windowIndex].Length
+			readEnd := min(windowEnd, fileEnd)
+			schedule.SampledBytes += readEnd - nextSamplePoint
+
+			nextSamplePoint = readEnd
+			if readEnd == windowEnd {
+				windowIndex++
+				if windowIndex < len(plan) {
+					nextSamplePoint = plan[windowIndex].Offset
+				}
+			}
+		}
+		currentOffset = fileEnd
+	}
+
+	for _, window := range plan {
+		if window.Offset < currentOffset {
+			schedule.SamplePoints++
+		}
+	}
+	return schedule
+}
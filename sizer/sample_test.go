@@ -0,0 +1,450 @@
+package sizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Write each of contents to a file of its own in dir, returning them in order as listed files
+func writeFiles(t *testing.T, dir string, contents ...string) []FileInfo {
+	t.Helper()
+	var files []FileInfo
+	for i, content := range contents {
+		path := filepath.Join(dir, fmt.Sprintf("file%02d", i))
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, FileInfo{Path: path, Size: int64(len(content))})
+	}
+	return files
+}
+
+// List files down a channel, as a walk would
+func listed(files []FileInfo) <-chan FileInfo {
+	fileInfoChan := make(chan FileInfo, len(files))
+	for _, file := range files {
+		fileInfoChan <- file
+	}
+	close(fileInfoChan)
+	return fileInfoChan
+}
+
+// Read the whole sampled stream, returning what was sampled and the totals
+func readStream(t *testing.T, stream *sampledStream, err error) (string, streamTotals) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), stream.finish()
+}
+
+func TestStreamSampledDataSampleSpansFiles(t *testing.T) {
+	// The stream is abcdefghijklmnop; the sample of the first chunk is bytes 6 to 10, which
+	// start in the first file and end in the second, and the second chunk's lies past the end
+	files := writeFiles(t, t.TempDir(), "abcdefgh", "ijklmnop")
+	var errorLog strings.Builder
+	stream, err := streamSampledData(context.Background(), listed(files), 10, 4, nil, nil, nil, 0, &errorLog, false)
+	data, totals := readStream(t, stream, err)
+
+	if data != "ghij" {
+		t.Errorf("sampled %q, want %q", data, "ghij")
+	}
+	if totals.sampledBytes != 4 || totals.samplePoints != 1 || totals.sampledFiles != 2 {
+		t.Errorf("sampled %d bytes at %d points in %d files, want 4 bytes at 1 point in 2 files", totals.sampledBytes, totals.samplePoints, totals.sampledFiles)
+	}
+	if totals.size != 16 || totals.files != 2 {
+		t.Errorf("totals are %d bytes in %d files, want 16 bytes in 2 files", totals.size, totals.files)
+	}
+	if errorLog.Len() > 0 {
+		t.Errorf("unexpected errors: %s", errorLog.String())
+	}
+}
+
+func TestStreamSampledDataSamplesSmallFiles(t *testing.T) {
+	// 500 files of 1 KB, each much smaller than a sample, in chunks that divide the stream
+	// evenly, so that each sample runs across seven files and the last ends with the last file
+	contents := make([]string, 500)
+	for i := range contents {
+		contents[i] = strings.Repeat(fmt.Sprintf("%04d", i), 256)
+	}
+	files := writeFiles(t, t.TempDir(), contents...)
+	whole := strings.Join(contents, "")
+	const chunkSize, sampleSize = 64000, 6400
+	var errorLog strings.Builder
+	stream, err := streamSampledData(context.Background(), listed(files), chunkSize, sampleSize, nil, nil, nil, 0, &errorLog, false)
+	data, totals := readStream(t, stream, err)
+
+	var want strings.Builder
+	sampledFiles := int64(0)
+	for chunkStart := 0; chunkStart < len(whole); chunkStart += chunkSize {
+		sampleStart := chunkStart + chunkSize - sampleSize
+		want.WriteString(whole[sampleStart : chunkStart+chunkSize])
+		sampledFiles += int64((chunkStart+chunkSize-1)/1024 - sampleStart/1024 + 1)
+	}
+	if data != want.String() {
+		t.Errorf("sampled %d bytes that differ from the %d bytes at the sample points", len(data), want.Len())
+	}
+	// A tenth of the stream, as the sample size is a tenth of the chunk size
+	if totals.sampledBytes != int64(len(whole))/10 || totals.samplePoints != int64(len(whole))/chunkSize {
+		t.Errorf("sampled %d bytes at %d points, want %d bytes at %d points", totals.sampledBytes, totals.samplePoints, len(whole)/10, len(whole)/chunkSize)
+	}
+	if totals.sampledFiles != sampledFiles {
+		t.Errorf("sampled %d files, want %d", totals.sampledFiles, sampledFiles)
+	}
+	if !strings.HasSuffix(data, contents[len(contents)-1]) {
+		t.Error("the last file was not sampled")
+	}
+	if errorLog.Len() > 0 {
+		t.Errorf("unexpected errors: %s", errorLog.String())
+	}
+}
+
+func TestStreamSampledDataSparseFile(t *testing.T) {
+	// A sparse file of almost 6 GB, so that the offsets pass 4 GB, then a marker file, with
+	// the last sample starting 2 KB before the end of the sparse file and running into the marker
+	const chunkSize, sampleSize = 1 << 30, 4096
+	dir := t.TempDir()
+	sparse := filepath.Join(dir, "sparse")
+	sparseSize := int64(6*chunkSize - 2048)
+	f, err := os.Create(sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(sparseSize); err != nil {
+		t.Skipf("cannot make a sparse file: %v", err)
+	}
+	// Label each sample point in the sparse file; the rest of it reads as zeros
+	var want strings.Builder
+	for i := int64(0); i < 6; i++ {
+		label := fmt.Sprintf("sample %d", i)
+		sampleStart := (i+1)*chunkSize - sampleSize
+		if _, err := f.WriteAt([]byte(label), sampleStart); err != nil {
+			t.Fatal(err)
+		}
+		window := make([]byte, min(sampleSize, sparseSize-sampleStart))
+		copy(window, label)
+		want.Write(window)
+	}
+	marker := strings.Repeat("marker", 1000)
+	want.WriteString(marker[:2048])
+	files := []FileInfo{{Path: sparse, Size: sparseSize}}
+	files = append(files, writeFiles(t, dir, marker)...)
+
+	var errorLog strings.Builder
+	stream, err := streamSampledData(context.Background(), listed(files), chunkSize, sampleSize, nil, nil, nil, 0, &errorLog, false)
+	data, totals := readStream(t, stream, err)
+
+	if data != want.String() {
+		t.Errorf("sampled %d bytes that differ from the %d bytes at the sample points", len(data), want.Len())
+	}
+	if totals.sampledBytes != 6*sampleSize || totals.samplePoints != 6 || totals.sampledFiles != 2 {
+		t.Errorf("sampled %d bytes at %d points in %d files, want %d bytes at 6 points in 2 files", totals.sampledBytes, totals.samplePoints, totals.sampledFiles, 6*sampleSize)
+	}
+	if wantSize := sparseSize + int64(len(marker)); totals.size != wantSize || totals.files != 2 {
+		t.Errorf("totals are %d bytes in %d files, want %d bytes in 2 files", totals.size, totals.files, wantSize)
+	}
+	if errorLog.Len() > 0 {
+		t.Errorf("unexpected errors: %s", errorLog.String())
+	}
+}
+
+func TestStreamSampledDataSkipsFilesChangedSinceListed(t *testing.T) {
+	// Each file is a chunk, sampled at its last four bytes; the second file is removed and the
+	// third truncated after they were listed
+	files := writeFiles(t, t.TempDir(), "aaaaaabbbb", "ccccccdddd", "eeeeeeffff", "gggggghhhh")
+	if err := os.Remove(files[1].Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(files[2].Path, 8); err != nil {
+		t.Fatal(err)
+	}
+	var errorLog strings.Builder
+	stream, err := streamSampledData(context.Background(), listed(files), 10, 4, nil, nil, nil, 0, &errorLog, false)
+	data, totals := readStream(t, stream, err)
+
+	if data != "bbbbffhhhh" {
+		t.Errorf("sampled %q, want %q", data, "bbbbffhhhh")
+	}
+	if totals.sampledFiles != 3 || totals.files != 4 || totals.size != 40 {
+		t.Errorf("sampled %d of %d files totalling %d bytes, want 3 of 4 totalling 40", totals.sampledFiles, totals.files, totals.size)
+	}
+	for _, file := range files[1:3] {
+		if !strings.Contains(errorLog.String(), file.Path) {
+			t.Errorf("no warning about %s in %q", file.Path, errorLog.String())
+		}
+	}
+}
+
+func TestStreamSampledDataSkipsFileWithoutSamplePoint(t *testing.T) {
+	dir := t.TempDir()
+	files := writeFiles(t, dir, "cdefghijkl")
+	// The first file ends before the first sample point, so it is never opened; its path
+	// does not exist, which would be reported if it were
+	files = append([]FileInfo{{Path: filepath.Join(dir, "missing"), Size: 2}}, files...)
+	var errorLog strings.Builder
+	stream, err := streamSampledData(context.Background(), listed(files), 10, 4, nil, nil, nil, 0, &errorLog, false)
+	data, totals := readStream(t, stream, err)
+
+	if data != "ghij" {
+		t.Errorf("sampled %q, want %q", data, "ghij")
+	}
+	if totals.sampledFiles != 1 || totals.files != 2 || totals.size != 12 {
+		t.Errorf("sampled %d of %d files totalling %d bytes, want 1 of 2 totalling 12", totals.sampledFiles, totals.files, totals.size)
+	}
+	if errorLog.Len() > 0 {
+		t.Errorf("the file without a sample point was opened: %s", errorLog.String())
+	}
+}
+
+func TestStreamSampledDataMatchesPlan(t *testing.T) {
+	dir := t.TempDir()
+	// Sizes around the chunk size, so that samples fall within files, across them and not
+	// in some at all
+	var contents []string
+	for i, size := range []int{1, 999, 1000, 1001, 37, 4096, 0, 250, 3333, 12} {
+		contents = append(contents, strings.Repeat(string(rune('a'+i)), size))
+	}
+	writeFiles(t, dir, contents...)
+
+	seed := int64(42)
+	for _, test := range []struct {
+		name string
+		seed *int64
+	}{
+		{"periodic", nil},
+		{"jittered", &seed},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.ChunkSize = 1000
+			opts.SampleRatio = 0.1
+			opts.Seed = test.seed
+			opts.Workers = 1
+
+			schedule, err := PlanSamples([]string{dir}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if schedule.SampledBytes == 0 {
+				t.Fatal("the plan samples nothing")
+			}
+			ctx := context.Background()
+			stream, _, err := streamSamples(ctx, []string{dir}, opts, listFiles(ctx, []string{dir}, opts), opts.sampleSize(), nil)
+			data, totals := readStream(t, stream, err)
+
+			if totals.sampledBytes != schedule.SampledBytes || int64(len(data)) != schedule.SampledBytes {
+				t.Errorf("sampled %d bytes (%d in the stream), the plan says %d", totals.sampledBytes, len(data), schedule.SampledBytes)
+			}
+			if totals.samplePoints != schedule.SamplePoints || totals.sampledFiles != schedule.SampledFiles {
+				t.Errorf("sampled %d points in %d files, the plan says %d in %d", totals.samplePoints, totals.sampledFiles, schedule.SamplePoints, schedule.SampledFiles)
+			}
+			if totals.size != schedule.TotalSize || totals.files != schedule.Files {
+				t.Errorf("totals are %d bytes in %d files, the plan says %d in %d", totals.size, totals.files, schedule.TotalSize, schedule.Files)
+			}
+		})
+	}
+}
+
+// flakyReader fails its first failures reads, after reading half of what was asked for
+type flakyReader struct {
+	data     []byte
+	failures int
+	calls    int
+}
+
+var errFlaky = errors.New("flaky read")
+
+func (r *flakyReader) ReadAt(p []byte, off int64) (int, error) {
+	r.calls++
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if r.calls <= r.failures {
+		return n / 2, errFlaky
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *flakyReader) Close() error {
+	return nil
+}
+
+func TestRetryingReader(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	tests := []struct {
+		name      string
+		failures  int
+		retries   int
+		wantCalls int
+		wantErr   error
+	}{
+		{"succeeds at once", 0, 2, 1, nil},
+		{"succeeds on the last retry", 2, 2, 3, nil},
+		{"never succeeds", 100, 2, 3, errFlaky},
+		{"no retries", 1, 0, 1, errFlaky},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flaky := &flakyReader{data: data, failures: test.failures}
+			reader := retryingReader{sampledReader: flaky, retries: test.retries}
+			buf := make([]byte, 8)
+			n, err := reader.ReadAt(buf, 4)
+
+			if err != test.wantErr {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+			if flaky.calls != test.wantCalls {
+				t.Errorf("read %d times, want %d", flaky.calls, test.wantCalls)
+			}
+			// Every read takes half of what is still missing, before it fails
+			if err == nil && (n != len(buf) || string(buf) != "456789ab") {
+				t.Errorf("read %d bytes %q, want %q", n, buf[:n], "456789ab")
+			}
+			if err != nil && (n == 0 || string(buf[:n]) != string(data[4:4+n])) {
+				t.Errorf("read %d bytes %q before failing, want a prefix of %q", n, buf[:n], "456789ab")
+			}
+		})
+	}
+}
+
+func TestRetryingReaderEndOfFile(t *testing.T) {
+	// Reading past the end is not a failure, so it is not retried
+	flaky := &flakyReader{data: []byte("abc")}
+	reader := retryingReader{sampledReader: flaky, retries: 3}
+	buf := make([]byte, 8)
+	if n, err := reader.ReadAt(buf, 1); n != 2 || err != io.EOF || flaky.calls != 1 {
+		t.Errorf("read %d bytes with %v in %d reads, want 2 bytes with EOF in 1 read", n, err, flaky.calls)
+	}
+}
+
+// Check that a plan's windows are non-empty, in order, do not overlap and lie in the stream,
+// returning the bytes they cover
+func checkPlan(t *testing.T, plan []SampleWindow, streamSize int64) int64 {
+	t.Helper()
+	total := int64(0)
+	end := int64(0)
+	for i, window := range plan {
+		if window.Length <= 0 || window.Offset < end || window.Offset+window.Length > streamSize {
+			t.Fatalf("window %d %+v is empty, overlaps the one before, which ends at %d, or passes the end of the %d byte stream", i, window, end, streamSize)
+		}
+		end = window.Offset + window.Length
+		total += window.Length
+	}
+	return total
+}
+
+func TestStratifiedPlan(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name        string
+		streamSize  int64
+		chunkSize   int64
+		sampleRatio float64
+		wantWindows int
+		wantBytes   int64
+	}{
+		{"whole strata", 100 * mb, 10 * mb, 0.1, 10, 10 * mb},
+		{"uneven strata", 100*mb + 12345, 10 * mb, 0.1, 10, (100*mb + 12345) / 10},
+		{"a last part of under half a chunk joins the strata", 104 * mb, 10 * mb, 0.5, 10, 52 * mb},
+		{"smaller than a chunk", 3 * mb, 10 * mb, 0.1, 1, 3 * mb / 10},
+		// Strata of less than PER_FILE_MIN_SAMPLE are sampled whole
+		{"tiny stream", 5000, 10 * mb, 0.1, 1, 5000},
+		{"tiny strata", 100 * 1000, 1000, 0.01, 100, 100 * 1000},
+		{"minimum sample", 10 * mb, mb, 0.01, 10, 10 * PER_FILE_MIN_SAMPLE},
+		{"everything", 50 * mb, 10 * mb, 1, 5, 50 * mb},
+		{"empty", 0, 10 * mb, 0.1, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, seed := range []*int64{nil, newSeed(1), newSeed(2)} {
+				plan := stratifiedPlan(test.streamSize, test.chunkSize, test.sampleRatio, newJitter(seed))
+				if len(plan) != test.wantWindows {
+					t.Errorf("%d windows, want %d", len(plan), test.wantWindows)
+				}
+				// Each window is at most a byte short, rounding down its stratum's share
+				if total := checkPlan(t, plan, test.streamSize); total > test.wantBytes || total < test.wantBytes-int64(len(plan)) {
+					t.Errorf("the windows cover %d bytes, want %d", total, test.wantBytes)
+				}
+			}
+		})
+	}
+}
+
+func TestContiguousPlan(t *testing.T) {
+	tests := []struct {
+		name        string
+		streamSize  int64
+		sampleRatio float64
+		wantBytes   int64
+	}{
+		{"a tenth", 10 << 20, 0.1, 1 << 20},
+		{"minimum sample", 10 << 20, 0.001, PER_FILE_MIN_SAMPLE},
+		{"tiny stream", 5000, 0.1, 5000},
+		{"everything", 10 << 20, 1, 10 << 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, seed := range []*int64{nil, newSeed(1), newSeed(2)} {
+				plan := contiguousPlan(test.streamSize, test.sampleRatio, newJitter(seed))
+				if len(plan) != 1 {
+					t.Fatalf("%d windows, want 1", len(plan))
+				}
+				if total := checkPlan(t, plan, test.streamSize); total != test.wantBytes {
+					t.Errorf("the window covers %d bytes, want %d", total, test.wantBytes)
+				}
+			}
+		})
+	}
+	if plan := contiguousPlan(0, 0.1, nil); plan != nil {
+		t.Errorf("an empty stream has the plan %v", plan)
+	}
+}
+
+func TestPlansAreReproducible(t *testing.T) {
+	const streamSize, chunkSize = 1 << 30, 10 << 20
+	plans := map[string]func(seed *int64) []SampleWindow{
+		"stratified": func(seed *int64) []SampleWindow {
+			return stratifiedPlan(streamSize, chunkSize, 0.1, newJitter(seed))
+		},
+		"contiguous": func(seed *int64) []SampleWindow {
+			return contiguousPlan(streamSize, 0.1, newJitter(seed))
+		},
+	}
+	for name, plan := range plans {
+		t.Run(name, func(t *testing.T) {
+			if !slices.Equal(plan(newSeed(7)), plan(newSeed(7))) {
+				t.Error("the same seed gave different plans")
+			}
+			if slices.Equal(plan(newSeed(7)), plan(newSeed(8))) {
+				t.Error("different seeds gave the same plan")
+			}
+			if slices.Equal(plan(newSeed(7)), plan(nil)) {
+				t.Error("a seed gave the same plan as no seed")
+			}
+			// Without a seed every window is taken from the middle of its stratum
+			if !slices.Equal(plan(nil), plan(nil)) {
+				t.Error("two plans without a seed differ")
+			}
+		})
+	}
+}
+
+func newSeed(seed int64) *int64 {
+	return &seed
+}
@@ -0,0 +1,1046 @@
+// Package sizer estimates the compressed size of a directory, such as the size of a gzipped
+// tarball of it, by compressing a small sample of its contents instead of all of it
+// The files are treated as one concatenated stream, a sampleSize piece of every chunkSize
+// of which is compressed; the ratio achieved on the samples is then applied to the total size
+package sizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CHUNKSIZE         = 10 * 1024 * 1024 // 10 MB, default chunk size
+	COMPRESSION_LEVEL = int(9)
+
+	// Number of consecutive sample windows the running ratio must stay within tolerance
+	// before adaptive sampling stops
+	ADAPTIVE_STABLE_WINDOWS = 3
+
+	// Size of the buffer the sampled data is read into on its way to the compressor, and the
+	// compressed data is counted with; 64 KB reads went about 1.5x faster than 4 KB ones
+	// with gzip and zstd, while larger buffers gained nothing more
+	COPY_BUFFER_SIZE = 64 * 1024 // 64 KB
+
+	// Amount of an existing archive's decompressed contents used to prime the compressor
+	PRIMER_SIZE = 1024 * 1024 // 1 MB
+
+	// Calibration runs the pipeline on generated data of this size, with a smaller chunk size
+	// so that enough sample points fall in it
+	CALIBRATION_SIZE       = 8 * 1024 * 1024 // 8 MB
+	CALIBRATION_CHUNK_SIZE = 1024 * 1024     // 1 MB
+
+	// Smallest window of the sampled stream compressed by one worker, so that small samples
+	// are compressed together rather than each paying for its own header
+	PARALLEL_MIN_WINDOW = 1024 * 1024 // 1 MB
+
+	// Smallest sample taken from a file smaller than a chunk with --per-file, or from a
+	// stratum with stratified sampling, so that small data is not judged on a few hundred bytes
+	PER_FILE_MIN_SAMPLE = 64 * 1024 // 64 KB
+
+	// Shortest time between two progress updates
+	PROGRESS_INTERVAL = time.Second
+
+	// Most compressors kept open at once to learn the ratios of file extensions; a tree with
+	// many extensions would otherwise hold an encoder, several MB for zstd or brotli, for each
+	MAX_LEARNING_ENCODERS = 16
+
+	// Normal quantile for a two-sided 95% confidence interval
+	CONFIDENCE_Z = 1.96
+
+	// Largest total size of the files in one stream. With sizes from a corrupt size index, the
+	// offsets into the stream could otherwise overflow; half of the int64 range leaves room
+	// for the sample points past the end and for tar headers
+	MAX_STREAM_SIZE = math.MaxInt64 / 2
+
+	// An adaptive sample ratio starts here and doubles until two estimates in a row differ
+	// by less than the tolerance, relative to the first
+	ADAPTIVE_RATIO_START     = 0.01
+	ADAPTIVE_RATIO_TOLERANCE = 0.01
+
+	// tar stores everything in blocks, and GNU tar writes the blocks in records of 20
+	TAR_BLOCK_SIZE  = 512
+	TAR_RECORD_SIZE = 20 * TAR_BLOCK_SIZE // 10 KB
+
+	// Samples held to be compressed several times over are moved from memory to a temporary
+	// file once they grow past this, by default
+	SAMPLE_MEMORY_LIMIT = 256 * 1024 * 1024 // 256 MB
+
+	// Directories read at once by a concurrent walk; the reads mostly wait on the filesystem,
+	// so there can be more of them than CPUs
+	WALK_WORKERS = 16
+
+	// Time waited before retrying a failed read of a file, doubling before every further retry
+	READ_RETRY_DELAY = 100 * time.Millisecond
+)
+
+// FileInfo struct to hold file path and size
+type FileInfo struct {
+	Path string
+	Size int64
+
+	data []byte                        // Contents of an entry that is not a file, such as a tar header; nil for files
+	open func() (sampledReader, error) // Opens a file stored in an archive, with OpenArchives; nil for other files
+}
+
+// Result struct to hold the outcome of an estimate, independent of how it is printed
+type Result struct {
+	TotalSize               int64
+	Files                   int64 // Files listed, whether they were sampled or not
+	EstimatedCompressedSize int64
+	Ratio                   float64
+	SampledBytes            int64         // Bytes sampled to converge, in adaptive mode
+	SampleRatio             float64       // Sample ratio the estimate settled on, with AdaptiveRatio
+	ActualCompressedSize    int64         // Size of the archive written with --create
+	CompressedPortion       int64         // Part of the estimate from files that shrink when compressed, with --breakdown
+	StoredPortion           int64         // Part of the estimate from files stored as is, with --breakdown
+	FilesBelowThreshold     int64         // Files too small to be compressed, with --compress-threshold
+	EncryptedFirstSize      int64         // Estimated size when encrypting before compressing, with --encrypt-then-compress
+	Partial                 bool          // The scan was stopped by the context, so only the files listed by then are counted
+	Elapsed                 time.Duration // Time taken from the start of the walk until the estimate was made, not counting --create
+
+	// The part of the estimate from the files of each extension (lower case, with the dot, or
+	// empty for files without one), with ByExtension
+	Extensions map[string]ExtensionResult
+
+	// The Top largest files listed, largest first, with Top
+	LargestFiles []FileInfo
+
+	// The space the files listed take on disk, with every file rounded up to whole blocks,
+	// with BlockSize. It says nothing of the estimate, which is of the data alone
+	DiskSize int64
+
+	// Half the width of the 95% confidence interval of the estimate, if HasConfidence is set
+	// It is only known when the samples were compressed as at least two windows
+	ConfidenceMargin int64
+	HasConfidence    bool
+
+	// The figures behind the estimate: the bytes of samples compressed, what they compressed
+	// to, and the size of the files sampled over the bytes of samples. The estimate is
+	// SampledCompressedBytes times ScaleFactor, plus the files whose ratio was assumed
+	SampledUncompressedBytes int64
+	SampledCompressedBytes   int64
+	ScaleFactor              float64
+}
+
+// ExtensionResult is the part of an estimate from the files of one extension
+// Sampled is not set if no sample fell in files of the extension, in which case their ratio
+// is that of the whole sample, or the assumed one
+type ExtensionResult struct {
+	TotalSize               int64   `json:"total_original_size"`
+	EstimatedCompressedSize int64   `json:"estimated_compressed_size"`
+	Ratio                   float64 `json:"compression_ratio"`
+	Sampled                 bool    `json:"sampled"`
+}
+
+// SampleSchedule describes the samples an estimate would take, as worked out by PlanSamples
+type SampleSchedule struct {
+	TotalSize    int64 // Size of all the listed files, including those with an assumed ratio
+	Files        int64 // Files listed
+	SampleSize   int64 // Bytes taken at each sample point; 0 when the windows come from a plan
+	SamplePoints int64 // Samples taken; a sample at the end of the stream may be shorter than SampleSize
+	SampledFiles int64 // Files at least one sample is read from
+	SampledBytes int64 // Bytes read for the samples, all of which are compressed
+}
+
+// FileResult is the estimate for a single file, with --per-file
+type FileResult struct {
+	Path                    string  `json:"path"`
+	TotalSize               int64   `json:"total_original_size"`
+	EstimatedCompressedSize int64   `json:"estimated_compressed_size"`
+	Ratio                   float64 `json:"compression_ratio"`
+}
+
+// Options controls how an estimate is made
+// The zero value is not usable; start from DefaultOptions and change what is needed
+type Options struct {
+	CompressionLevel     int
+	CompressionAlgorithm string    // One of CompressionAlgorithms
+	SampleRatio          float64   // Fraction of every chunk that is sampled, in (0, 1]
+	SampleSize           int64     // Bytes sampled from every chunk, at most ChunkSize; if not 0 it takes the place of SampleRatio
+	ChunkSize            int64     // Distance between sample points
+	Sampling             string    // One of SamplingModes; stratified and contiguous list the files twice, so they cannot read FilesFrom from stdin
+	Sort                 string    // One of SortOrders; other than none, every file is listed before the first is sampled
+	Workers              int       // Samples compressed in parallel; 1 compresses them as one continuous stream
+	Verbose              bool      // Log what is happening with the log package, which writes to stderr unless redirected
+	Progress             io.Writer // If not nil, the number of files and bytes listed so far is written here now and then
+	Errors               io.Writer // Paths that cannot be listed are reported here; nil discards the reports
+	DumpSample           io.Writer // If not nil, the sampled bytes are copied here as they are compressed
+	MaxSampleMemory      int64     // Samples held by SweepLevels and Benchmark past this many bytes are kept in a temporary file; 0 for no limit
+	ReadRetries          int       // Times a failed read of a file is retried, with backoff, before the rest of the file is skipped
+
+	// If not nil, EstimateFiles and EstimateFilesFunc call it with each file's estimate as
+	// soon as it is made, in the order the files are listed, so a long scan can be followed live
+	OnFile func(FileResult)
+
+	// Keep sampling until the running ratio changes by less than Tolerance between windows,
+	// drawing at most MaxSample bytes (0 for no limit)
+	Adaptive  bool
+	Tolerance float64
+	MaxSample int64
+
+	// Ignore SampleRatio and SampleSize and estimate again and again, doubling the ratio from
+	// ADAPTIVE_RATIO_START, until two estimates in a row agree within ADAPTIVE_RATIO_TOLERANCE
+	// Every round samples the files anew, so it cannot be combined with Create, Learned or
+	// DumpSample, which would act on every round
+	AdaptiveRatio bool
+
+	ExcludeRegex    []*regexp.Regexp // Matched against the path relative to the directory
+	Exclude         []string         // Glob patterns matched against the base name
+	ExcludeFullPath bool             // Match Exclude against the relative path instead
+	Include         []string         // Extensions to estimate, as returned by ParseExtensions; empty for all
+	MaxDepth        int              // Levels of subdirectories to descend into (0 for none); negative for no limit
+	FollowSymlinks  bool             // List what symlinks point to; otherwise they are skipped
+	Gitignore       bool             // Skip what the .gitignore files in the directory ignore, and .git directories
+	MinSize         int64            // Skip files smaller than this
+	MaxSize         int64            // Skip files larger than this; 0 for no limit
+	Top             int              // Report this many of the largest files listed along with the estimate
+	BlockSize       int64            // Add up the size on disk of the files listed, in whole blocks of this many bytes; 0 to leave it out
+	ConcurrentWalk  bool             // Read the directories ahead of the walk concurrently; the files are listed in the same order
+	OpenArchives    bool             // List the files stored in a .tar or .zip given in place of a directory, uncompressed, instead of the archive itself
+
+	SamplePlan          []SampleWindow // Exact windows to sample instead of periodic sampling
+	Seed                *int64         // Jitter the periodic sample points with this seed
+	DeltaFilter         bool           // XOR-delta each file against its previous version
+	AgainstArchive      string         // Existing archive whose contents prime the compressor
+	EncryptThenCompress bool           // Also estimate the size when encrypting before compressing
+	Breakdown           bool           // Split the estimate into compressed and stored portions
+	ByExtension         bool           // Break the estimate down by file extension, compressing the samples of each on their own
+	CompressThreshold   int64          // Files smaller than this are counted at their original size
+	Tar                 bool           // Estimate a tar archive of the files, headers and padding included, instead of the files alone; ignored by EstimateFiles
+	SkipCompressed      bool           // Count files of the CompressedExtensions at their original size instead of sampling them
+	SizeIndex           string         // Listing of sizes and paths to read instead of walking the directory
+	FilesFrom           string         // List of paths to read instead of walking the directory; "-" for stdin
+	Create              string         // Also write a real archive to this path and report its size
+	CacheDir            string         // Directory to cache estimates in, keyed by the settings and the listed files' sizes and modification times
+
+	// Ratios learned per extension for the algorithm and level, updated with the ratios
+	// sampled in this run if not nil; with UseLearned they replace sampling
+	Learned    map[string]LearnedRatio
+	UseLearned bool
+
+	// Ratios to assume for the files under these path prefixes, relative to the directory
+	Hints map[string]float64
+
+	// Extensions SkipCompressed counts at their original size in place of the
+	// CompressedExtensions, if not nil
+	CompressedExtensions []string
+
+	// A preset dictionary for the compressor to start from, if not nil; only gzip and zstd
+	// can use one, see SupportsDictionary
+	Dictionary []byte
+}
+
+// DefaultOptions returns the options the command line tool uses when no flags are given
+func DefaultOptions() Options {
+	return Options{
+		CompressionLevel:     COMPRESSION_LEVEL,
+		CompressionAlgorithm: "gzip",
+		SampleRatio:          0.1,
+		ChunkSize:            CHUNKSIZE,
+		Sampling:             "streaming",
+		Sort:                 "none",
+		Workers:              1,
+		Tolerance:            0.001,
+		MaxDepth:             -1,
+		MaxSampleMemory:      SAMPLE_MEMORY_LIMIT,
+		Errors:               os.Stderr,
+	}
+}
+
+// The filter that applies the options' exclude and include lists to the walk
+func (opts Options) filter() *fileFilter {
+	return &fileFilter{
+		excludeRegex:      opts.ExcludeRegex,
+		excludeGlobs:      opts.Exclude,
+		globFullPath:      opts.ExcludeFullPath,
+		includeExtensions: opts.Include,
+		maxDepth:          opts.MaxDepth,
+		followSymlinks:    opts.FollowSymlinks,
+		gitignore:         opts.Gitignore,
+		minSize:           opts.MinSize,
+		maxSize:           opts.MaxSize,
+		concurrentWalk:    opts.ConcurrentWalk,
+		openArchives:      opts.OpenArchives,
+	}
+}
+
+// The bytes sampled from every chunk: SampleSize, or SampleRatio of a chunk
+func (opts Options) sampleSize() int64 {
+	if opts.SampleSize > 0 {
+		return min(opts.SampleSize, opts.ChunkSize)
+	}
+	return int64(float64(opts.ChunkSize) * opts.SampleRatio)
+}
+
+// The fraction of every chunk sampled, which SampleSize works out if it is set
+func (opts Options) sampleRatio() float64 {
+	if opts.SampleSize > 0 {
+		return float64(opts.sampleSize()) / float64(opts.ChunkSize)
+	}
+	return opts.SampleRatio
+}
+
+// The extensions of the files SkipCompressed leaves out of the sample
+func (opts Options) compressedExtensions() []string {
+	if opts.CompressedExtensions == nil {
+		return CompressedExtensions
+	}
+	return opts.CompressedExtensions
+}
+
+// The writer listing errors are reported to, which discards them if Errors is nil
+func (opts Options) errorLog() io.Writer {
+	if opts.Errors == nil {
+		return io.Discard
+	}
+	return opts.Errors
+}
+
+// Estimate the compressed size of a directory
+func Estimate(directory string, opts Options) (Result, error) {
+	return EstimateDirectories([]string{directory}, opts)
+}
+
+// errEmptySample is returned when the sample ratio and chunk size round down to samples of
+// zero bytes, which would leave nothing to measure the ratio on
+var errEmptySample = errors.New("the sample size rounds down to zero bytes; increase the sample ratio or chunk size")
+
+// Estimate the compressed size of one or more directories, sampled as one stream, with every
+// algorithm that supports the compression level, compressing the same samples with each
+// The results are keyed by algorithm. Options that only make sense for one algorithm, such as
+// learned ratios, adaptive sampling or --create, are ignored
+func CompareAlgorithms(directories []string, opts Options) (map[string]Result, error) {
+	start := time.Now()
+	sampleSize := opts.sampleSize()
+	if sampleSize < 1 {
+		return nil, errEmptySample
+	}
+
+	// Stop the listing on an early return, so its goroutines are not left blocked
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Learned ratios belong to a single algorithm
+	opts.UseLearned = false
+	sampledData, assumed, err := streamSamples(ctx, directories, opts, listFiles(ctx, directories, opts), sampleSize, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error streaming sampled data: %v", err)
+	}
+	defer sampledData.Close()
+
+	var algorithms []string
+	for _, algorithm := range CompressionAlgorithms {
+		if opts.CompressionLevel >= MinCompressionLevel(algorithm) && opts.CompressionLevel <= MaxCompressionLevel(algorithm) {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	ratios, err := compressAll(sampledData, opts.CompressionLevel, algorithms)
+	nothingSampled := errors.Is(err, errNothingSampled)
+	if err != nil && !nothingSampled {
+		return nil, fmt.Errorf("error during compression: %v", err)
+	}
+	totals := sampledData.finish()
+	if opts.Verbose {
+		logSamples(totals)
+		for i, algorithm := range algorithms {
+			if !nothingSampled {
+				log.Printf("%s compressed the samples to %d bytes", algorithm, int64(float64(totals.sampledBytes)*ratios[i]))
+			}
+		}
+	}
+
+	// The algorithms compress the samples side by side, so they all take as long as the slowest
+	elapsed := time.Since(start)
+	results := make(map[string]Result, len(algorithms))
+	for i, algorithm := range algorithms {
+		ratio := float64(0)
+		if !nothingSampled {
+			ratio = ratios[i]
+		}
+		result := newResult(totals, assumed, ratio, nothingSampled)
+		result.Elapsed = elapsed
+		results[algorithm] = result
+	}
+	return results, nil
+}
+
+// BenchmarkResult is an estimate together with how long compressing its samples took
+type BenchmarkResult struct {
+	Result
+	Runs     int // Times the samples were compressed
+	MinTime  time.Duration
+	MeanTime time.Duration
+	MaxTime  time.Duration
+}
+
+// Sample one or more directories once, as one stream, and compress the samples repeat times
+// with each of the algorithms, timing every run, to compare their CPU cost alongside their ratio
+// The samples are held, in memory up to MaxSampleMemory, so that only compressing them is
+// timed, not reading the files. The results are keyed by algorithm; as with
+// CompareAlgorithms, options that only make sense for one algorithm are ignored
+func Benchmark(directories []string, opts Options, algorithms []string, repeat int) (map[string]BenchmarkResult, error) {
+	samples, totals, assumed, err := readSamples(directories, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer samples.Close()
+	nothingSampled := samples.size == 0
+
+	results := make(map[string]BenchmarkResult, len(algorithms))
+	for _, algorithm := range algorithms {
+		benchmark := BenchmarkResult{Runs: repeat}
+		ratio := float64(0)
+		var totalTime time.Duration
+		for run := 0; run < repeat && !nothingSampled; run++ {
+			start := time.Now()
+			ratio, err = compressData(samples.reader(), opts.CompressionLevel, algorithm, opts.Dictionary, nil)
+			elapsed := time.Since(start)
+			if err != nil {
+				return nil, fmt.Errorf("error during compression: %v", err)
+			}
+			totalTime += elapsed
+			if run == 0 || elapsed < benchmark.MinTime {
+				benchmark.MinTime = elapsed
+			}
+			benchmark.MaxTime = max(benchmark.MaxTime, elapsed)
+		}
+		if repeat > 0 {
+			benchmark.MeanTime = totalTime / time.Duration(repeat)
+		}
+		benchmark.Result = newResult(totals, assumed, ratio, nothingSampled)
+		benchmark.SampledBytes = samples.size
+		results[algorithm] = benchmark
+	}
+	return results, nil
+}
+
+// LevelResult is the estimate at one compression level, with how long compressing the
+// samples at that level took
+type LevelResult struct {
+	Result
+	Level int
+	Time  time.Duration
+}
+
+// Sample one or more directories once, as one stream, and compress the samples at every level
+// of the algorithm, timing each, to find the level with the best tradeoff of ratio and speed
+// The samples are held, in memory up to MaxSampleMemory, so the files are only read once and
+// only compressing them is timed. Levels run from 1, or the algorithm's lowest level if
+// higher, to its highest
+func SweepLevels(directories []string, opts Options) ([]LevelResult, error) {
+	samples, totals, assumed, err := readSamples(directories, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer samples.Close()
+	nothingSampled := samples.size == 0
+
+	var results []LevelResult
+	for level := max(1, MinCompressionLevel(opts.CompressionAlgorithm)); level <= MaxCompressionLevel(opts.CompressionAlgorithm); level++ {
+		ratio := float64(0)
+		start := time.Now()
+		if !nothingSampled {
+			ratio, err = compressData(samples.reader(), level, opts.CompressionAlgorithm, opts.Dictionary, nil)
+			if err != nil {
+				return nil, fmt.Errorf("error during compression: %v", err)
+			}
+		}
+		result := LevelResult{Result: newResult(totals, assumed, ratio, nothingSampled), Level: level, Time: time.Since(start)}
+		result.SampledBytes = samples.size
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Sample the directories as one stream and hold the samples, so that they can be compressed
+// several times over; they are moved to a temporary file past opts.MaxSampleMemory
+// Learned ratios are not used, so that every file is sampled
+func readSamples(directories []string, opts Options) (*sampleBuffer, streamTotals, *assumedTotals, error) {
+	sampleSize := opts.sampleSize()
+	if sampleSize < 1 {
+		return nil, streamTotals{}, nil, errEmptySample
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts.UseLearned = false
+	sampledData, assumed, err := streamSamples(ctx, directories, opts, listFiles(ctx, directories, opts), sampleSize, nil)
+	if err != nil {
+		return nil, streamTotals{}, nil, fmt.Errorf("error streaming sampled data: %v", err)
+	}
+	defer sampledData.Close()
+	samples := &sampleBuffer{memoryLimit: opts.MaxSampleMemory}
+	if _, err := io.Copy(samples, sampledData); err != nil {
+		samples.Close()
+		return nil, streamTotals{}, nil, fmt.Errorf("error reading sampled data: %v", err)
+	}
+	return samples, sampledData.finish(), assumed, nil
+}
+
+// Start listing the files of the directories and their sizes down a channel
+// With a size index or a file list the listing is read from it rather than walked, and with a
+// progress writer the files are counted on their way through. Unless opts.Sort is none, the
+// files are passed on in that order once all of them are listed
+// The stream is cut off at MAX_STREAM_SIZE, which is reported to the error log
+func listFiles(ctx context.Context, directories []string, opts Options) <-chan FileInfo {
+	fileInfoChan := make(chan FileInfo)
+	if opts.SizeIndex != "" {
+		go readSizeIndex(ctx, opts.SizeIndex, opts.errorLog(), fileInfoChan)
+	} else if opts.FilesFrom != "" {
+		go readFileList(ctx, opts.FilesFrom, opts.errorLog(), fileInfoChan)
+	} else {
+		go listDirectories(ctx, directories, opts.filter(), opts.errorLog(), fileInfoChan)
+	}
+	listedChan := limitStreamSize(ctx, fileInfoChan, MAX_STREAM_SIZE, opts.errorLog())
+	if opts.Progress != nil {
+		listedChan = reportProgress(ctx, listedChan, opts.Progress)
+	}
+	if opts.Sort != "" && opts.Sort != "none" {
+		listedChan = sortFiles(ctx, listedChan, opts.Sort)
+	}
+	return listedChan
+}
+
+// Log what was read for the samples
+func logSamples(totals streamTotals) {
+	log.Printf("Sampled %d bytes at %d sample points in %d of %d files", totals.sampledBytes, totals.samplePoints, totals.sampledFiles, totals.files)
+}
+
+// Calculate the estimated compressed size based on the total size and compression ratio
+// Files with an assumed ratio are added on top of the sampled part
+// If no sample point fell in the remaining files, they are counted at their original size
+func newResult(totals streamTotals, assumed *assumedTotals, compressedRatio float64, nothingSampled bool) Result {
+	estimatedCompressedSize := assumed.compressedSize
+	if nothingSampled {
+		estimatedCompressedSize += float64(totals.size)
+	} else {
+		estimatedCompressedSize += float64(totals.size) * compressedRatio
+	}
+	result := Result{
+		TotalSize:               totals.size + assumed.size,
+		Files:                   totals.files + assumed.files,
+		EstimatedCompressedSize: int64(estimatedCompressedSize),
+		FilesBelowThreshold:     assumed.belowThreshold,
+	}
+	if result.TotalSize > 0 {
+		result.Ratio = estimatedCompressedSize / float64(result.TotalSize)
+	}
+	if !nothingSampled && totals.sampledBytes > 0 {
+		result.SampledUncompressedBytes = totals.sampledBytes
+		result.SampledCompressedBytes = int64(float64(totals.sampledBytes) * compressedRatio)
+		result.ScaleFactor = float64(totals.size) / float64(totals.sampledBytes)
+	}
+	return result
+}
+
+// Take the files whose ratio is known out of the listing, adding them to assumed, and pass
+// on the files to be sampled
+// Files below the compression threshold, under a hinted path, already compressed (with
+// SkipCompressed) or of an extension with a learned ratio are not sampled. Small files are
+// stored as is whatever their contents, and hints take precedence over the extension
+func sampledFiles(ctx context.Context, directories []string, opts Options, fileInfoChan <-chan FileInfo, assumed *assumedTotals) <-chan FileInfo {
+	if opts.Tar {
+		fileInfoChan = addTarEntries(ctx, directories, fileInfoChan)
+	}
+	sampledFileChan := fileInfoChan
+	if opts.CompressThreshold > 0 || len(opts.Hints) > 0 || opts.SkipCompressed || opts.UseLearned || assumed.extensions != nil {
+		sampledFileChan = assumeRatios(ctx, fileInfoChan, assumed, func(file FileInfo) (float64, bool) {
+			if file.Size < opts.CompressThreshold {
+				assumed.belowThreshold++
+				return 1, true
+			}
+			if ratio, ok := hintedRatio(opts.Hints, rootDirectory(directories, file.Path), file.Path); ok {
+				return ratio, true
+			}
+			if opts.SkipCompressed && slices.Contains(opts.compressedExtensions(), fileExtension(file.Path)) {
+				return 1, true
+			}
+			if opts.UseLearned {
+				ratio, ok := opts.Learned[fileExtension(file.Path)]
+				return ratio.Ratio, ok
+			}
+			return 0, false
+		})
+	}
+	return sampledFileChan
+}
+
+// Plan the samples of stratified or contiguous sampling over the stream of files to be sampled
+// A first walk finds the size of that stream; errors are left to be reported by the second
+func twoPassSamplePlan(ctx context.Context, directories []string, opts Options) []SampleWindow {
+	firstPass := opts
+	firstPass.Errors = nil
+	streamSize := int64(0)
+	for file := range sampledFiles(ctx, directories, firstPass, listFiles(ctx, directories, firstPass), &assumedTotals{}) {
+		streamSize += file.Size
+	}
+
+	if opts.Sampling == "contiguous" {
+		plan := contiguousPlan(streamSize, opts.sampleRatio(), newJitter(opts.Seed))
+		if opts.Verbose && len(plan) > 0 {
+			log.Printf("Contiguous sampling: %d bytes from offset %d of %d bytes", plan[0].Length, plan[0].Offset, streamSize)
+		}
+		return plan
+	}
+	plan := stratifiedPlan(streamSize, opts.ChunkSize, opts.sampleRatio(), newJitter(opts.Seed))
+	if opts.Verbose {
+		log.Printf("Stratified sampling: %d windows over %d bytes", len(plan), streamSize)
+	}
+	return plan
+}
+
+// Take the files whose ratio is known out of the listing and stream samples of the rest
+// The returned totals of the files with a known ratio are complete once the sampled stream
+// has finished
+func streamSamples(ctx context.Context, directories []string, opts Options, fileInfoChan <-chan FileInfo, sampleSize int64, observe sampleObserver) (*sampledStream, *assumedTotals, error) {
+	assumed := &assumedTotals{}
+	if opts.ByExtension {
+		assumed.extensions = make(map[string]*extensionTotals)
+	}
+	sampledFileChan := sampledFiles(ctx, directories, opts, fileInfoChan, assumed)
+
+	// Stream the sampled data from the files, following the explicit plan if one was given
+	var sampledData *sampledStream
+	var err error
+	if opts.SamplePlan != nil {
+		sampledData, err = streamPlannedData(ctx, sampledFileChan, opts.SamplePlan, observe, opts.ReadRetries, opts.errorLog(), opts.Verbose)
+	} else if opts.Sampling == "stratified" || opts.Sampling == "contiguous" {
+		sampledData, err = streamPlannedData(ctx, sampledFileChan, twoPassSamplePlan(ctx, directories, opts), observe, opts.ReadRetries, opts.errorLog(), opts.Verbose)
+	} else {
+		var delta *deltaFilter
+		if opts.DeltaFilter {
+			delta = newDeltaFilter()
+		}
+		sampledData, err = streamSampledData(ctx, sampledFileChan, opts.ChunkSize, sampleSize, newJitter(opts.Seed), delta, observe, opts.ReadRetries, opts.errorLog(), opts.Verbose)
+	}
+	if err == nil && opts.DumpSample != nil {
+		sampledData.teeTo(opts.DumpSample)
+	}
+	return sampledData, assumed, err
+}
+
+// Work out the samples an estimate of the directories as one stream would take, from the file
+// sizes alone, without reading or compressing anything
+// This shows what a run would cost before making it
+func PlanSamples(directories []string, opts Options) (SampleSchedule, error) {
+	sampleSize := opts.sampleSize()
+	if sampleSize < 1 {
+		return SampleSchedule{}, errEmptySample
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assumed := &assumedTotals{}
+	sampledFileChan := sampledFiles(ctx, directories, opts, listFiles(ctx, directories, opts), assumed)
+
+	var schedule SampleSchedule
+	if opts.SamplePlan != nil {
+		schedule = schedulePlannedData(sampledFileChan, opts.SamplePlan)
+	} else if opts.Sampling == "stratified" || opts.Sampling == "contiguous" {
+		schedule = schedulePlannedData(sampledFileChan, twoPassSamplePlan(ctx, directories, opts))
+	} else {
+		schedule = scheduleSampledData(sampledFileChan, opts.ChunkSize, sampleSize, newJitter(opts.Seed))
+		schedule.SampleSize = sampleSize
+	}
+	schedule.TotalSize += assumed.size
+	schedule.Files += assumed.files
+	return schedule, nil
+}
+
+// Estimate the compressed size of one or more directories, sampled as one stream, as for a
+// single archive holding them all
+func EstimateDirectories(directories []string, opts Options) (Result, error) {
+	return EstimateDirectoriesContext(context.Background(), directories, opts)
+}
+
+// EstimateDirectoriesContext is EstimateDirectories, stopping the scan once ctx is done
+// The files listed by then are estimated from what was sampled of them, and the result is
+// marked as Partial
+// With a CacheDir, an estimate of the same files with the same settings is read from the cache
+// instead of being made again, and a new estimate is stored there; partial ones are not
+func EstimateDirectoriesContext(ctx context.Context, directories []string, opts Options) (Result, error) {
+	if !opts.cacheable() {
+		return estimateDirectories(ctx, directories, opts)
+	}
+
+	start := time.Now()
+	key, err := cacheKey(ctx, directories, opts)
+	if err != nil {
+		return estimateDirectories(ctx, directories, opts)
+	}
+	if result, ok := readCachedResult(opts.CacheDir, key); ok {
+		if opts.Verbose {
+			log.Printf("Using the cached estimate %s", key)
+		}
+		result.Elapsed = time.Since(start)
+		return result, nil
+	}
+
+	result, err := estimateDirectories(ctx, directories, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if !result.Partial {
+		if err := writeCachedResult(opts.CacheDir, key, result); err != nil {
+			fmt.Fprintf(opts.errorLog(), "Error writing the estimate to the cache: %v\n", err)
+		}
+	}
+	result.Elapsed = time.Since(start)
+	return result, nil
+}
+
+// Make the estimate of EstimateDirectoriesContext, without the cache
+func estimateDirectories(ctx context.Context, directories []string, opts Options) (Result, error) {
+	if opts.AdaptiveRatio {
+		return estimateAdaptiveRatio(ctx, directories, opts)
+	}
+	start := time.Now()
+
+	// Stop the listing on an early return, so its goroutines are not left blocked on a
+	// file no one will take
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Calculate the sample size based on the sample ratio
+	sampleSize := opts.sampleSize()
+	if sampleSize < 1 {
+		return Result{}, errEmptySample
+	}
+
+	// List the files and their sizes down a channel, keeping the largest on the way with Top
+	fileInfoChan := listFiles(ctx, directories, opts)
+	var largest *largestFiles
+	if opts.Top > 0 {
+		largest = &largestFiles{n: opts.Top}
+		fileInfoChan = trackLargest(ctx, fileInfoChan, largest)
+	}
+	var diskSize atomic.Int64
+	if opts.BlockSize > 0 {
+		fileInfoChan = countBlocks(ctx, fileInfoChan, opts.BlockSize, &diskSize)
+	}
+
+	// Learn from this run's samples, or compress the samples of each extension on their own
+	// to break the estimate down by extension
+	var learner *extensionLearner
+	var observe sampleObserver
+	if opts.Learned != nil || opts.ByExtension {
+		learner = newExtensionLearner(opts.CompressionLevel, opts.CompressionAlgorithm)
+		observe = learner.observe
+	}
+
+	// Decide file by file whether each sampled file would be compressed or stored
+	var classifier *storageClassifier
+	if opts.Breakdown {
+		classifier = newStorageClassifier(opts.CompressionLevel, opts.CompressionAlgorithm)
+		observe = combineObservers(observe, classifier.observe)
+	}
+
+	// Stream the sampled data from the files
+	sampledData, assumed, err := streamSamples(ctx, directories, opts, fileInfoChan, sampleSize, observe)
+	if err != nil {
+		return Result{}, fmt.Errorf("error streaming sampled data: %v", err)
+	}
+	defer sampledData.Close()
+
+	// Compress the sampled data and calculate the compression ratio
+	var compressedRatio float64
+	var encryptedRatio float64
+	var windowRatios []float64
+	var sampledBytes int64
+	if opts.AgainstArchive != "" {
+		primer, primerErr := readArchivePrimer(opts.AgainstArchive, PRIMER_SIZE)
+		if primerErr != nil {
+			return Result{}, fmt.Errorf("error reading archive: %v", primerErr)
+		}
+		compressedRatio, err = compressPrimed(
+			sampledData,
+			primer,
+			sampleSize,
+			opts.CompressionLevel,
+			opts.CompressionAlgorithm,
+		)
+	} else if opts.Adaptive {
+		compressedRatio, sampledBytes, err = compressAdaptive(
+			sampledData,
+			sampleSize,
+			opts.MaxSample,
+			opts.Tolerance,
+			opts.CompressionLevel,
+			opts.CompressionAlgorithm,
+			opts.Dictionary,
+			opts.Verbose,
+		)
+	} else if opts.EncryptThenCompress {
+		compressedRatio, encryptedRatio, err = compressBothOrders(
+			sampledData,
+			opts.CompressionLevel,
+			opts.CompressionAlgorithm,
+		)
+	} else if opts.Workers > 1 {
+		compressedRatio, windowRatios, err = compressParallel(
+			sampledData,
+			max(sampleSize, PARALLEL_MIN_WINDOW),
+			opts.Workers,
+			opts.CompressionLevel,
+			opts.CompressionAlgorithm,
+			opts.Dictionary,
+		)
+	} else {
+		// Measure the windows from the stream's progress, for the confidence interval
+		windows := newWindowProgress(max(sampleSize, PARALLEL_MIN_WINDOW), opts.CompressionLevel, opts.CompressionAlgorithm, opts.Dictionary)
+		compressedRatio, err = compressData(
+			sampledData,
+			opts.CompressionLevel,
+			opts.CompressionAlgorithm,
+			opts.Dictionary,
+			windows.progress,
+		)
+		if err == nil {
+			windows.finish(compressedRatio)
+		}
+		windowRatios = windows.ratios
+	}
+	nothingSampled := errors.Is(err, errNothingSampled)
+	if err != nil && !nothingSampled {
+		return Result{}, fmt.Errorf("error during compression: %v", err)
+	}
+	totals := sampledData.finish()
+	// Adaptive sampling stops reading the samples part way, so only what it read was compressed
+	if opts.Adaptive {
+		totals.sampledBytes = sampledBytes
+	}
+	if opts.Verbose {
+		logSamples(totals)
+		log.Printf("Compressed the samples to %d bytes", int64(float64(totals.sampledBytes)*compressedRatio))
+		if !nothingSampled && totals.sampledBytes > 0 {
+			log.Printf("Scaled them by %.4f, the %d bytes of the files sampled over the bytes of samples", float64(totals.size)/float64(totals.sampledBytes), totals.size)
+		}
+	}
+
+	// Record the ratios sampled for each extension in this run
+	var sampledRatios map[string]LearnedRatio
+	if learner != nil {
+		sampledRatios, err = learner.ratios()
+		if err != nil {
+			return Result{}, fmt.Errorf("error during compression: %v", err)
+		}
+		if opts.Learned != nil {
+			mergeLearnedRatios(opts.Learned, sampledRatios)
+		}
+	}
+
+	result := newResult(totals, assumed, compressedRatio, nothingSampled)
+	result.SampledBytes = sampledBytes
+	result.Partial = totals.partial
+	if largest != nil {
+		result.LargestFiles = largest.sorted()
+	}
+	result.DiskSize = diskSize.Load()
+
+	// Extensions no sample fell in are estimated with the ratio of the whole sample
+	if opts.ByExtension {
+		result.Extensions = make(map[string]ExtensionResult, len(assumed.extensions))
+		for extension, sizes := range assumed.extensions {
+			ratio, sampled := sampledRatios[extension]
+			estimatedCompressedSize := sizes.assumedCompressedSize
+			if sampled {
+				estimatedCompressedSize += float64(sizes.sampledSize) * ratio.Ratio
+			} else if nothingSampled {
+				estimatedCompressedSize += float64(sizes.sampledSize)
+			} else {
+				estimatedCompressedSize += float64(sizes.sampledSize) * compressedRatio
+			}
+			extensionResult := ExtensionResult{
+				TotalSize:               sizes.sampledSize + sizes.assumedSize,
+				EstimatedCompressedSize: int64(estimatedCompressedSize),
+				Sampled:                 sampled,
+			}
+			if extensionResult.TotalSize > 0 {
+				extensionResult.Ratio = estimatedCompressedSize / float64(extensionResult.TotalSize)
+			}
+			result.Extensions[extension] = extensionResult
+		}
+	}
+
+	// Only the sampled files are uncertain; assumed ratios are taken as exact
+	// The windows of a contiguous sample all come from one part of the stream, so how much
+	// they vary says nothing about the rest of it
+	if margin, ok := ratioMargin(windowRatios); ok && !nothingSampled && opts.Sampling != "contiguous" {
+		result.ConfidenceMargin = int64(float64(totals.size) * margin)
+		result.HasConfidence = true
+	}
+
+	// Encrypted data does not compress, so files with an assumed ratio keep their size
+	if opts.EncryptThenCompress {
+		encryptedFirstSize := float64(totals.size) * encryptedRatio
+		if nothingSampled {
+			encryptedFirstSize = float64(totals.size)
+		}
+		result.EncryptedFirstSize = int64(encryptedFirstSize) + assumed.size
+	}
+
+	// Stored files keep their original size, so the stored portion is the sampled part scaled
+	// by the fraction of sampled bytes that came from stored files, plus assumed stored files
+	if classifier != nil {
+		storedFraction, err := classifier.storedFraction()
+		if err != nil {
+			return Result{}, fmt.Errorf("error during compression: %v", err)
+		}
+		if nothingSampled {
+			storedFraction = 1
+		}
+		storedPortion := min(float64(totals.size)*storedFraction+assumed.storedSize, float64(result.EstimatedCompressedSize))
+		result.StoredPortion = int64(storedPortion)
+		result.CompressedPortion = result.EstimatedCompressedSize - result.StoredPortion
+	}
+	result.Elapsed = time.Since(start)
+
+	// Optionally create the real archive to compare its size with the estimate, unless the
+	// estimate was cut short
+	if opts.Create != "" && !result.Partial {
+		result.ActualCompressedSize, err = createArchive(
+			directories[0],
+			opts.filter(),
+			opts.errorLog(),
+			opts.Create,
+			opts.CompressionLevel,
+			opts.CompressionAlgorithm,
+			opts.Verbose,
+		)
+		if err != nil {
+			return Result{}, fmt.Errorf("error creating archive: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+// Estimate the directories at a doubling sample ratio until the estimate stops changing
+// Keeping the chunk size, the sample points stay where they were and only grow, so each round
+// takes in the samples of the last one. A round cut short by ctx ends the search with its
+// partial result, and a ratio of 1 ends it as nothing more can be sampled
+func estimateAdaptiveRatio(ctx context.Context, directories []string, opts Options) (Result, error) {
+	start := time.Now()
+	opts.AdaptiveRatio = false
+	opts.SampleSize = 0
+	opts.SampleRatio = max(ADAPTIVE_RATIO_START, 1/float64(opts.ChunkSize))
+
+	var previous Result
+	for round := 0; ; round++ {
+		result, err := estimateDirectories(ctx, directories, opts)
+		if err != nil {
+			return Result{}, err
+		}
+		result.SampleRatio = opts.SampleRatio
+		if opts.Verbose {
+			log.Printf("Sample ratio %.4f: estimated %d bytes", opts.SampleRatio, result.EstimatedCompressedSize)
+		}
+
+		converged := round > 0 && math.Abs(float64(result.EstimatedCompressedSize-previous.EstimatedCompressedSize)) <= ADAPTIVE_RATIO_TOLERANCE*float64(previous.EstimatedCompressedSize)
+		if converged || result.Partial || opts.SampleRatio >= 1 {
+			result.Elapsed = time.Since(start)
+			return result, nil
+		}
+		previous = result
+		opts.SampleRatio = min(2*opts.SampleRatio, 1)
+	}
+}
+
+// Estimate the compressed size of every file in a directory on its own
+// Files smaller than a chunk are sampled as a single chunk of their own size, taking at least
+// PER_FILE_MIN_SAMPLE bytes, so that every file gets a sample. Files below the compression
+// threshold, files under a hinted path and, with SkipCompressed, already compressed files get
+// the assumed ratio instead
+func EstimateFiles(directory string, opts Options) ([]FileResult, error) {
+	var results []FileResult
+	err := EstimateFilesFunc(directory, opts, func(result FileResult) error {
+		results = append(results, result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// EstimateFilesFunc is EstimateFiles, handing each file's estimate to fn as soon as it is
+// made instead of collecting them, so that memory stays flat however many files there are
+// The estimates come in the order the files are listed. An error from fn stops the estimates
+// and is returned
+func EstimateFilesFunc(directory string, opts Options, fn func(FileResult) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fileInfoChan := listFiles(ctx, []string{directory}, opts)
+
+	var delta *deltaFilter
+	if opts.DeltaFilter {
+		delta = newDeltaFilter()
+	}
+	jitter := newJitter(opts.Seed)
+
+	for file := range fileInfoChan {
+		var ratio float64
+		if file.Size < opts.CompressThreshold {
+			ratio = 1
+		} else if hinted, ok := hintedRatio(opts.Hints, directory, file.Path); ok {
+			ratio = hinted
+		} else if opts.SkipCompressed && slices.Contains(opts.compressedExtensions(), fileExtension(file.Path)) {
+			ratio = 1
+		} else {
+			chunkSize := opts.ChunkSize
+			sampleSize := opts.sampleSize()
+			if file.Size < chunkSize {
+				chunkSize = file.Size
+				sampleSize = max(int64(float64(chunkSize)*opts.sampleRatio()), min(chunkSize, PER_FILE_MIN_SAMPLE))
+			}
+
+			singleFile := make(chan FileInfo, 1)
+			singleFile <- file
+			close(singleFile)
+			sampledData, err := streamSampledData(ctx, singleFile, chunkSize, sampleSize, jitter, delta, nil, opts.ReadRetries, opts.errorLog(), opts.Verbose)
+			if err != nil {
+				return err
+			}
+			// The samples of every file are dumped one after another
+			if opts.DumpSample != nil {
+				sampledData.teeTo(opts.DumpSample)
+			}
+			ratio, err = compressData(sampledData, opts.CompressionLevel, opts.CompressionAlgorithm, opts.Dictionary, nil)
+			// A compressor that failed part way leaves the stream blocked on its next sample
+			sampledData.Close()
+			// Empty files have nothing to sample and keep their size of zero
+			if errors.Is(err, errNothingSampled) {
+				ratio, err = 1, nil
+			}
+			if err != nil {
+				return fmt.Errorf("error compressing '%s': %v", file.Path, err)
+			}
+		}
+
+		result := FileResult{
+			Path:                    file.Path,
+			TotalSize:               file.Size,
+			EstimatedCompressedSize: int64(float64(file.Size) * ratio),
+			Ratio:                   ratio,
+		}
+		if opts.OnFile != nil {
+			opts.OnFile(result)
+		}
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
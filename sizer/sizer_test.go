@@ -0,0 +1,85 @@
+package sizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Check that every goroutine run has started has stopped once it returns
+// The listing and sampling goroutines are stopped through a cancelled context, so they are
+// given a moment to wind down
+func checkNoLeak(t *testing.T, name string, run func()) {
+	t.Helper()
+	before := runtime.NumGoroutine()
+	run()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%s left %d goroutines running", name, after-before)
+	}
+}
+
+func TestEntryPointsStopTheirGoroutines(t *testing.T) {
+	// Enough files that the listing is still running when an estimate returns early
+	dir := t.TempDir()
+	contents := make([]string, 200)
+	for i := range contents {
+		contents[i] = strings.Repeat(fmt.Sprintf("line %d of some text\n", i), 100)
+	}
+	writeFiles(t, dir, contents...)
+	missing := filepath.Join(dir, "missing")
+
+	opts := DefaultOptions()
+	opts.ChunkSize = 4096
+	var errorLog strings.Builder
+	opts.Errors = &errorLog
+	badLevel := opts
+	badLevel.CompressionLevel = 100
+	emptySample := opts
+	emptySample.SampleRatio = 1e-9
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	errStop := errors.New("stop")
+
+	tests := []struct {
+		name    string
+		run     func() error
+		wantErr bool
+	}{
+		{"Estimate", func() error { _, err := Estimate(dir, opts); return err }, false},
+		{"Estimate of a missing directory", func() error { _, err := Estimate(missing, opts); return err }, false},
+		{"Estimate at an invalid level", func() error { _, err := Estimate(dir, badLevel); return err }, true},
+		{"Estimate of an empty sample", func() error { _, err := Estimate(dir, emptySample); return err }, true},
+		{"Estimate with a cancelled context", func() error {
+			result, err := EstimateDirectoriesContext(cancelled, []string{dir}, opts)
+			if err == nil && !result.Partial {
+				t.Error("an estimate with a cancelled context is not partial")
+			}
+			return err
+		}, false},
+		{"EstimateFiles", func() error { _, err := EstimateFiles(dir, opts); return err }, false},
+		{"EstimateFiles of a missing directory", func() error { _, err := EstimateFiles(missing, opts); return err }, false},
+		{"EstimateFiles at an invalid level", func() error { _, err := EstimateFiles(dir, badLevel); return err }, true},
+		{"EstimateFilesFunc stopped by its callback", func() error {
+			return EstimateFilesFunc(dir, opts, func(FileResult) error { return errStop })
+		}, true},
+		{"CompareAlgorithms", func() error { _, err := CompareAlgorithms([]string{dir}, opts); return err }, false},
+		{"CompareAlgorithms of a missing directory", func() error { _, err := CompareAlgorithms([]string{missing}, opts); return err }, false},
+		{"CompareAlgorithms of an empty sample", func() error { _, err := CompareAlgorithms([]string{dir}, emptySample); return err }, true},
+	}
+	for _, test := range tests {
+		checkNoLeak(t, test.name, func() {
+			if err := test.run(); (err != nil) != test.wantErr {
+				t.Errorf("%s returned %v, want an error %v", test.name, err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package sizer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Insert what tar adds around the files into the listing, so that the stream sampled is that
+// of a tar archive of the files rather than their bare concatenation
+// Every file is preceded by its header, as archive/tar writes it for a regular file of that
+// name and size (with PAX records for long names), and followed by zeros up to the next
+// 512-byte block. The archive ends with two zero blocks, padded with zeros to a whole
+// 10 KB record as GNU tar does. Mode, owner and modification time are not known from the
+// listing, so every header gets the same ones; directories get no entries of their own
+// The entries added carry their contents in memory and are not counted as files
+func addTarEntries(ctx context.Context, directories []string, fileInfoChan <-chan FileInfo) <-chan FileInfo {
+	tarChan := make(chan FileInfo)
+	zeros := make([]byte, TAR_RECORD_SIZE)
+	modTime := time.Now().Truncate(time.Second)
+
+	go func() {
+		defer close(tarChan)
+
+		archiveSize := int64(0)
+		send := func(file FileInfo) bool {
+			archiveSize += file.Size
+			return sendFile(ctx, tarChan, file)
+		}
+
+		files := 0
+		for file, ok := nextFile(ctx, fileInfoChan); ok; file, ok = nextFile(ctx, fileInfoChan) {
+			files++
+			var header bytes.Buffer
+			tarWriter := tar.NewWriter(&header)
+			err := tarWriter.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     tarName(directories, file.Path),
+				Size:     file.Size,
+				Mode:     0o644,
+				ModTime:  modTime,
+			})
+			if err == nil && !send(FileInfo{Path: file.Path, Size: int64(header.Len()), data: header.Bytes()}) {
+				return
+			}
+			if !send(file) {
+				return
+			}
+			if padding := (TAR_BLOCK_SIZE - file.Size%TAR_BLOCK_SIZE) % TAR_BLOCK_SIZE; padding > 0 {
+				if !send(FileInfo{Path: file.Path, Size: padding, data: zeros[:padding]}) {
+					return
+				}
+			}
+		}
+		if files == 0 || ctx.Err() != nil {
+			return
+		}
+
+		end := int64(2 * TAR_BLOCK_SIZE)
+		end += (TAR_RECORD_SIZE - (archiveSize+end)%TAR_RECORD_SIZE) % TAR_RECORD_SIZE
+		send(FileInfo{Size: end, data: zeros[:end]})
+	}()
+
+	return tarChan
+}
+
+// The name a file is stored under in a tar archive of the directories: its path relative to
+// the directory it was listed in, with forward slashes
+// A file given on its own keeps its base name, and listed paths are used as they are, without
+// a leading slash, as tar stores them
+func tarName(directories []string, path string) string {
+	name := path
+	if len(directories) > 0 {
+		if relativePath, err := filepath.Rel(rootDirectory(directories, path), path); err == nil {
+			name = relativePath
+		}
+		if name == "." {
+			name = filepath.Base(path)
+		}
+	}
+	return strings.TrimLeft(filepath.ToSlash(name), "/")
+}
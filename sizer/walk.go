@@ -0,0 +1,754 @@
+package sizer
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// List all files in a directory and send their sizes
+// Send it down a channel as it arrives
+// This is done to avoid loading all file sizes into memory at once
+// Paths matching any of the filter's exclude patterns are skipped; matching directories are
+// pruned from the walk entirely, as are directories below the maximum depth. Files without an
+// included extension are skipped too, and so are paths git ignores if the filter follows
+// .gitignore files
+// Paths that cannot be accessed are reported to errorLog and skipped
+// The walk stops early once ctx is done
+func listFilesWithSizes(ctx context.Context, directory string, filter *fileFilter, errorLog io.Writer, fileInfoChan chan<- FileInfo) {
+	defer close(fileInfoChan)
+
+	// A single file given in place of a directory is listed on its own, without a walk, and
+	// an archive as the files stored in it if they are asked for
+	if info, err := os.Stat(directory); err == nil && info.Mode().IsRegular() {
+		if filter != nil && filter.openArchives && isArchive(directory) {
+			listArchiveEntries(ctx, directory, filter, errorLog, fileInfoChan)
+			return
+		}
+		sendFile(ctx, fileInfoChan, FileInfo{Path: directory, Size: info.Size()})
+		return
+	}
+
+	if filter != nil && filter.concurrentWalk {
+		walkConcurrently(ctx, directory, filter, errorLog, fileInfoChan)
+		return
+	}
+
+	// Directories entered through a symlink, so that each is walked only once
+	var visited []os.FileInfo
+
+	// The patterns of the .gitignore files met so far, if they are followed
+	var gitignore gitignoreRules
+	if filter != nil && filter.gitignore {
+		gitignore = make(gitignoreRules)
+	}
+
+	var walkFn filepath.WalkFunc
+	walkFn = func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			fmt.Fprintf(errorLog, "Error accessing path %s: %v\n", path, err)
+			return nil // Log the error and continue
+		}
+		if filter.excludes(directory, path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && filter.tooDeep(directory, path) {
+			return filepath.SkipDir
+		}
+
+		// Nothing in git's own directory is committed, nor is anything git ignores; the
+		// .gitignore of every directory that is not skipped applies to the paths below it
+		if gitignore != nil && filepath.Clean(path) != filepath.Clean(directory) {
+			if (info.IsDir() && info.Name() == ".git") || gitignore.ignores(directory, path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if gitignore != nil && info.IsDir() {
+			if err := gitignore.load(path); err != nil {
+				fmt.Fprintf(errorLog, "Error reading .gitignore in %s: %v\n", path, err)
+			}
+		}
+
+		// A symlink's own size says nothing about what it points to, so symlinks are either
+		// resolved or skipped
+		if info.Mode()&os.ModeSymlink != 0 {
+			if filter == nil || !filter.followSymlinks {
+				return nil
+			}
+			target, err := os.Stat(path)
+			if err != nil {
+				fmt.Fprintf(errorLog, "Error following symlink %s: %v\n", path, err)
+				return nil
+			}
+			if !target.IsDir() {
+				info = target
+			} else {
+				if filter.tooDeep(directory, path) || symlinkCycle(directory, path, target, visited) {
+					return nil
+				}
+				visited = append(visited, target)
+				// The trailing separator makes the walk enter the directory the link points to
+				return filepath.Walk(path+string(filepath.Separator), walkFn)
+			}
+		}
+
+		// Sockets, devices and named pipes have no contents to estimate, and reading one could
+		// block forever
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			fmt.Fprintf(errorLog, "Skipping %s: not a regular file\n", path)
+			return nil
+		}
+		if !info.IsDir() && filter.includes(path) && filter.sizeIncluded(info.Size()) {
+			if !sendFile(ctx, fileInfoChan, FileInfo{Path: path, Size: info.Size()}) {
+				return filepath.SkipAll
+			}
+		}
+		return nil
+	}
+
+	if err := filepath.Walk(directory, walkFn); err != nil {
+		fmt.Fprintf(errorLog, "Error: %v\n", err)
+	}
+}
+
+// A directory's entries, read ahead of the walk
+type directoryListing struct {
+	entries      []directoryEntry
+	err          error          // Reading the directory failed, and entries is empty
+	gitignore    gitignoreRules // The directory's .gitignore patterns, if they are followed
+	gitignoreErr error
+}
+
+// A path in a directory listing and what Lstat says about it
+type directoryEntry struct {
+	path string
+	info os.FileInfo
+	err  error
+}
+
+// Read a directory's entries, in the sorted order filepath.Walk walks them, and its
+// .gitignore if loadGitignore is set
+func readDirectoryListing(path string, loadGitignore bool) directoryListing {
+	var listing directoryListing
+	if loadGitignore {
+		listing.gitignore = make(gitignoreRules)
+		listing.gitignoreErr = listing.gitignore.load(path)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		listing.err = err
+		return listing
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		listing.entries = append(listing.entries, directoryEntry{path: filepath.Join(path, entry.Name()), info: info, err: err})
+	}
+	return listing
+}
+
+// List the files of a directory as the walk of listFilesWithSizes does, while the
+// directories are read ahead of it concurrently
+// The walk itself stays in one goroutine and lists the files in the same order, so every
+// sampling mode, the cache and the estimates are the same as without. Instead of waiting on
+// one read after the other, as filepath.Walk does, the subdirectories of each directory
+// entered are all read at once, up to WALK_WORKERS at a time, which pays off where every read
+// waits on a network round trip. Subdirectories that will be skipped are not read
+func walkConcurrently(ctx context.Context, directory string, filter *fileFilter, errorLog io.Writer, fileInfoChan chan<- FileInfo) {
+	// Every read sends its listing, even once ctx is done, so that none is waited on forever
+	slots := make(chan struct{}, WALK_WORKERS)
+	readAhead := func(path string) <-chan directoryListing {
+		listingChan := make(chan directoryListing, 1)
+		go func() {
+			select {
+			case slots <- struct{}{}:
+				listingChan <- readDirectoryListing(path, filter.gitignore)
+				<-slots
+			case <-ctx.Done():
+				listingChan <- directoryListing{err: ctx.Err()}
+			}
+		}()
+		return listingChan
+	}
+
+	var visited []os.FileInfo
+	var gitignore gitignoreRules
+	if filter.gitignore {
+		gitignore = make(gitignoreRules)
+	}
+
+	// Whether the walk skips a path, as the walk function of listFilesWithSizes decides
+	skips := func(path string, info os.FileInfo) bool {
+		if filter.excludes(directory, path) || (info.IsDir() && filter.tooDeep(directory, path)) {
+			return true
+		}
+		return gitignore != nil && filepath.Clean(path) != filepath.Clean(directory) &&
+			((info.IsDir() && info.Name() == ".git") || gitignore.ignores(directory, path, info.IsDir()))
+	}
+
+	// Walk a directory once its listing arrives; false means the walk is to stop
+	var walkDirectory func(path string, listingChan <-chan directoryListing) bool
+	// List a path other than a directory, following it if it is a symlink
+	visit := func(path string, info os.FileInfo) bool {
+		if skips(path, info) {
+			return true
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !filter.followSymlinks {
+				return true
+			}
+			target, err := os.Stat(path)
+			if err != nil {
+				fmt.Fprintf(errorLog, "Error following symlink %s: %v\n", path, err)
+				return true
+			}
+			if target.IsDir() {
+				if filter.tooDeep(directory, path) || symlinkCycle(directory, path, target, visited) {
+					return true
+				}
+				visited = append(visited, target)
+				return walkDirectory(path, readAhead(path))
+			}
+			info = target
+		}
+		if !info.Mode().IsRegular() {
+			fmt.Fprintf(errorLog, "Skipping %s: not a regular file\n", path)
+			return true
+		}
+		if filter.includes(path) && filter.sizeIncluded(info.Size()) {
+			return sendFile(ctx, fileInfoChan, FileInfo{Path: path, Size: info.Size()})
+		}
+		return true
+	}
+	walkDirectory = func(path string, listingChan <-chan directoryListing) bool {
+		listing := <-listingChan
+		if ctx.Err() != nil {
+			return false
+		}
+		if listing.gitignoreErr != nil {
+			fmt.Fprintf(errorLog, "Error reading .gitignore in %s: %v\n", path, listing.gitignoreErr)
+		}
+		for gitignoreDirectory, patterns := range listing.gitignore {
+			gitignore[gitignoreDirectory] = patterns
+		}
+		if listing.err != nil {
+			fmt.Fprintf(errorLog, "Error accessing path %s: %v\n", path, listing.err)
+			return true
+		}
+
+		// Start reading every subdirectory that will be walked before walking the first
+		subdirectories := make([]<-chan directoryListing, len(listing.entries))
+		for i, entry := range listing.entries {
+			if entry.err == nil && entry.info.IsDir() && !skips(entry.path, entry.info) {
+				subdirectories[i] = readAhead(entry.path)
+			}
+		}
+		for i, entry := range listing.entries {
+			if ctx.Err() != nil {
+				return false
+			}
+			switch {
+			case entry.err != nil:
+				fmt.Fprintf(errorLog, "Error accessing path %s: %v\n", entry.path, entry.err)
+			case subdirectories[i] != nil:
+				if !walkDirectory(entry.path, subdirectories[i]) {
+					return false
+				}
+			case !entry.info.IsDir():
+				if !visit(entry.path, entry.info) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	info, err := os.Lstat(directory)
+	if err != nil {
+		fmt.Fprintf(errorLog, "Error accessing path %s: %v\n", directory, err)
+		return
+	}
+	if info.IsDir() {
+		walkDirectory(directory, readAhead(directory))
+	} else {
+		visit(directory, info)
+	}
+}
+
+// Send a listed file down the channel, unless ctx is done first
+// Every stage of the pipeline sends and receives this way, so that none of them waits forever
+// on a stage that has stopped, or on a walk stuck on an unresponsive mount
+func sendFile(ctx context.Context, fileInfoChan chan<- FileInfo, file FileInfo) bool {
+	select {
+	case fileInfoChan <- file:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Receive the next listed file, or report the listing as finished once ctx is done
+func nextFile(ctx context.Context, fileInfoChan <-chan FileInfo) (FileInfo, bool) {
+	select {
+	case file, ok := <-fileInfoChan:
+		return file, ok
+	case <-ctx.Done():
+		return FileInfo{}, false
+	}
+}
+
+// Check whether following a symlink to a directory would walk a directory again: one that
+// was already entered through another symlink, or one the link itself lies in
+func symlinkCycle(directory, path string, target os.FileInfo, visited []os.FileInfo) bool {
+	for _, seen := range visited {
+		if os.SameFile(seen, target) {
+			return true
+		}
+	}
+	for parent := filepath.Dir(path); ; parent = filepath.Dir(parent) {
+		if parentInfo, err := os.Stat(parent); err == nil && os.SameFile(parentInfo, target) {
+			return true
+		}
+		relativePath, err := filepath.Rel(directory, parent)
+		if err != nil || relativePath == "." || strings.HasPrefix(relativePath, "..") || parent == filepath.Dir(parent) {
+			return false
+		}
+	}
+}
+
+// Pass the listed files on until their total size reaches limit (0 for no limit)
+// The file that would take it past is counted up to the limit only, and the files after it
+// are left out, both reported to errorLog, so that no offset into the stream overflows,
+// however large the sizes a size index claims
+func limitStreamSize(ctx context.Context, fileInfoChan <-chan FileInfo, limit int64, errorLog io.Writer) <-chan FileInfo {
+	limitedChan := make(chan FileInfo)
+	go func() {
+		defer close(limitedChan)
+
+		total := int64(0)
+		for file, ok := nextFile(ctx, fileInfoChan); ok; file, ok = nextFile(ctx, fileInfoChan) {
+			if limit > 0 && file.Size > limit-total {
+				if total == limit {
+					fmt.Fprintf(errorLog, "Error: the total has reached %d bytes, skipping %s\n", limit, file.Path)
+					continue
+				}
+				fmt.Fprintf(errorLog, "Error: %s is %d bytes, which would take the total past %d bytes, counting only its first %d\n", file.Path, file.Size, limit, limit-total)
+				file.Size = limit - total
+			}
+			total += file.Size
+			if !sendFile(ctx, limitedChan, file) {
+				return
+			}
+		}
+	}()
+	return limitedChan
+}
+
+// Orders the files can be sampled in: none keeps the order they are found in, name sorts them
+// by path, size from the smallest up and mtime from the oldest up
+// The samples fall at fixed offsets of the stream of files, so an order that does not depend
+// on how the filesystem returns them gives the same estimate on every run
+var SortOrders = []string{"none", "name", "size", "mtime"}
+
+// Pass the listed files on in the given order of SortOrders, once all of them are listed
+// Only the paths and sizes are held, not the contents. Files whose modification time cannot
+// be read, such as the entries of an archive, sort as the oldest, and ties go by path
+func sortFiles(ctx context.Context, fileInfoChan <-chan FileInfo, order string) <-chan FileInfo {
+	sortedChan := make(chan FileInfo)
+	go func() {
+		defer close(sortedChan)
+
+		var files []FileInfo
+		for file, ok := nextFile(ctx, fileInfoChan); ok; file, ok = nextFile(ctx, fileInfoChan) {
+			files = append(files, file)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		modTimes := make(map[string]time.Time)
+		if order == "mtime" {
+			for _, file := range files {
+				if info, err := os.Stat(file.Path); err == nil {
+					modTimes[file.Path] = info.ModTime()
+				}
+			}
+		}
+		slices.SortFunc(files, func(a, b FileInfo) int {
+			switch order {
+			case "size":
+				if c := cmp.Compare(a.Size, b.Size); c != 0 {
+					return c
+				}
+			case "mtime":
+				if c := modTimes[a.Path].Compare(modTimes[b.Path]); c != 0 {
+					return c
+				}
+			}
+			return strings.Compare(a.Path, b.Path)
+		})
+
+		for _, file := range files {
+			if !sendFile(ctx, sortedChan, file) {
+				return
+			}
+		}
+	}()
+	return sortedChan
+}
+
+// Pass the listed files on unchanged while reporting how many files and bytes have gone by
+// Updates overwrite each other on one line and come at most every PROGRESS_INTERVAL, so
+// that a terminal is not flooded; a final update ends the line once the listing is done
+func reportProgress(ctx context.Context, fileInfoChan <-chan FileInfo, w io.Writer) <-chan FileInfo {
+	reportedChan := make(chan FileInfo)
+	go func() {
+		defer close(reportedChan)
+
+		files, bytes := 0, int64(0)
+		lastUpdate := time.Now()
+		for file, ok := nextFile(ctx, fileInfoChan); ok; file, ok = nextFile(ctx, fileInfoChan) {
+			files++
+			bytes += file.Size
+			if time.Since(lastUpdate) >= PROGRESS_INTERVAL {
+				fmt.Fprintf(w, "\rScanned %d files, %d bytes", files, bytes)
+				lastUpdate = time.Now()
+			}
+			if !sendFile(ctx, reportedChan, file) {
+				break
+			}
+		}
+		fmt.Fprintf(w, "\rScanned %d files, %d bytes\n", files, bytes)
+	}()
+	return reportedChan
+}
+
+// largestFiles keeps the n largest of the files that go by, in a min-heap on their size so
+// that the smallest of them is the one replaced by a larger file
+// A stopped listing may still be adding a file when the result is made, hence the lock
+type largestFiles struct {
+	mu    sync.Mutex
+	n     int
+	files []FileInfo
+}
+
+func (l *largestFiles) Len() int           { return len(l.files) }
+func (l *largestFiles) Less(i, j int) bool { return l.files[i].Size < l.files[j].Size }
+func (l *largestFiles) Swap(i, j int)      { l.files[i], l.files[j] = l.files[j], l.files[i] }
+func (l *largestFiles) Push(x any)         { l.files = append(l.files, x.(FileInfo)) }
+func (l *largestFiles) Pop() any {
+	file := l.files[len(l.files)-1]
+	l.files = l.files[:len(l.files)-1]
+	return file
+}
+
+// Keep a file if it is among the n largest so far
+func (l *largestFiles) add(file FileInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.files) < l.n {
+		heap.Push(l, file)
+	} else if len(l.files) > 0 && file.Size > l.files[0].Size {
+		l.files[0] = file
+		heap.Fix(l, 0)
+	}
+}
+
+// The files kept, largest first
+func (l *largestFiles) sorted() []FileInfo {
+	l.mu.Lock()
+	files := slices.Clone(l.files)
+	l.mu.Unlock()
+	slices.SortFunc(files, func(a, b FileInfo) int {
+		if a.Size != b.Size {
+			return cmp.Compare(b.Size, a.Size)
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	return files
+}
+
+// Pass the listed files on unchanged while keeping the largest of them in largest
+// Only the n largest are held at any time, however many files go by
+func trackLargest(ctx context.Context, fileInfoChan <-chan FileInfo, largest *largestFiles) <-chan FileInfo {
+	trackedChan := make(chan FileInfo)
+	go func() {
+		defer close(trackedChan)
+
+		for file, ok := nextFile(ctx, fileInfoChan); ok; file, ok = nextFile(ctx, fileInfoChan) {
+			largest.add(file)
+			if !sendFile(ctx, trackedChan, file) {
+				return
+			}
+		}
+	}()
+	return trackedChan
+}
+
+// Pass the listed files on unchanged while adding up the space they take on disk in diskSize,
+// each rounded up to whole blocks of blockSize bytes
+// This is the allocation a filesystem of that block size makes, not counting indirect blocks
+// or the directories themselves; an empty file takes no block
+func countBlocks(ctx context.Context, fileInfoChan <-chan FileInfo, blockSize int64, diskSize *atomic.Int64) <-chan FileInfo {
+	countedChan := make(chan FileInfo)
+	go func() {
+		defer close(countedChan)
+
+		for file, ok := nextFile(ctx, fileInfoChan); ok; file, ok = nextFile(ctx, fileInfoChan) {
+			diskSize.Add((file.Size + blockSize - 1) / blockSize * blockSize)
+			if !sendFile(ctx, countedChan, file) {
+				return
+			}
+		}
+	}()
+	return countedChan
+}
+
+// List the files of several directories one after the other down a single channel, as if
+// they were one directory
+// Directories that overlap, and symlinks when they are followed, can reach the same file
+// twice; each file is then only listed under the first path it is found by, so that it is not
+// counted twice. Only then are the real paths of the files resolved and kept
+func listDirectories(ctx context.Context, directories []string, filter *fileFilter, errorLog io.Writer, fileInfoChan chan<- FileInfo) {
+	defer close(fileInfoChan)
+
+	var seen map[string]bool
+	if len(directories) > 1 || (filter != nil && filter.followSymlinks) {
+		seen = make(map[string]bool)
+	}
+
+	for _, directory := range directories {
+		directoryChan := make(chan FileInfo)
+		go listFilesWithSizes(ctx, directory, filter, errorLog, directoryChan)
+		for file, ok := nextFile(ctx, directoryChan); ok; file, ok = nextFile(ctx, directoryChan) {
+			if seen != nil {
+				if path, err := realPath(file.Path); err == nil {
+					if seen[path] {
+						continue
+					}
+					seen[path] = true
+				}
+			}
+			if !sendFile(ctx, fileInfoChan, file) {
+				return
+			}
+		}
+	}
+}
+
+// The absolute path of a file with every symlink on the way resolved, the same for every
+// path that leads to the file
+func realPath(path string) (string, error) {
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(absolutePath)
+}
+
+// Find which of the directories a listed path lies in
+func rootDirectory(directories []string, path string) string {
+	for _, directory := range directories {
+		relativePath, err := filepath.Rel(directory, path)
+		if err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			return directory
+		}
+	}
+	return directories[0]
+}
+
+// Read file sizes and paths from an existing listing instead of walking a directory
+// Each line holds a size in bytes and a path, separated by a space or a tab, as produced by
+// find <directory> -type f -printf '%s %p\n'. Files are only opened later, for sampling
+// Malformed lines are reported to errorLog and skipped
+func readSizeIndex(ctx context.Context, indexPath string, errorLog io.Writer, fileInfoChan chan<- FileInfo) {
+	defer close(fileInfoChan)
+
+	f, err := os.Open(indexPath)
+	if err != nil {
+		fmt.Fprintf(errorLog, "Error: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		separator := strings.IndexAny(line, " \t")
+		if separator < 0 {
+			fmt.Fprintf(errorLog, "Error in size index line %d: %q\n", lineNumber, line)
+			continue
+		}
+		size, err := strconv.ParseInt(line[:separator], 10, 64)
+		path := line[separator+1:]
+		if err != nil || size < 0 || path == "" {
+			fmt.Fprintf(errorLog, "Error in size index line %d: %q\n", lineNumber, line)
+			continue
+		}
+		if !sendFile(ctx, fileInfoChan, FileInfo{Path: path, Size: size}) {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(errorLog, "Error: %v\n", err)
+	}
+}
+
+// Read the paths of the files to estimate from a list, one per line, as produced by find
+// The list is read from stdin if listPath is "-". Each file is looked up for its size;
+// paths that cannot be, and paths that are not regular files, are reported to errorLog and skipped
+func readFileList(ctx context.Context, listPath string, errorLog io.Writer, fileInfoChan chan<- FileInfo) {
+	defer close(fileInfoChan)
+
+	list := os.Stdin
+	if listPath != "-" {
+		f, err := os.Open(listPath)
+		if err != nil {
+			fmt.Fprintf(errorLog, "Error: %v\n", err)
+			return
+		}
+		defer f.Close()
+		list = f
+	}
+
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		path := scanner.Text()
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(errorLog, "Error accessing path %s: %v\n", path, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			fmt.Fprintf(errorLog, "Skipping %s: not a regular file\n", path)
+			continue
+		}
+		if !sendFile(ctx, fileInfoChan, FileInfo{Path: path, Size: info.Size()}) {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(errorLog, "Error: %v\n", err)
+	}
+}
+
+// fileFilter decides which files and directories the walk skips
+type fileFilter struct {
+	excludeRegex []*regexp.Regexp // Matched against the path relative to the scanned directory
+	excludeGlobs []string         // Matched against the base name, or the relative path if globFullPath is set
+	globFullPath bool
+
+	includeExtensions []string // Lower case, with the leading dot; when empty every file is included
+	maxDepth          int      // Levels of subdirectories to descend into; negative for no limit
+	followSymlinks    bool     // List what symlinks point to instead of skipping them
+	gitignore         bool     // Skip what the .gitignore files found in the walk ignore, and .git directories
+	minSize           int64    // Files smaller than this are skipped
+	maxSize           int64    // Files larger than this are skipped; 0 for no limit
+	concurrentWalk    bool     // Read the directories ahead of the walk concurrently
+	openArchives      bool     // List the entries of an archive given in place of a directory
+}
+
+// Check whether a file's size is within the size limits
+func (f *fileFilter) sizeIncluded(size int64) bool {
+	if f == nil {
+		return true
+	}
+	return size >= f.minSize && (f.maxSize <= 0 || size <= f.maxSize)
+}
+
+// Check whether the files of a subdirectory lie deeper than the maximum depth
+// Files directly in the scanned directory are at depth 0, those in its subdirectories at 1
+func (f *fileFilter) tooDeep(directory, path string) bool {
+	if f == nil || f.maxDepth < 0 {
+		return false
+	}
+	relativePath, err := filepath.Rel(directory, path)
+	if err != nil || relativePath == "." {
+		return false
+	}
+	depth := strings.Count(filepath.ToSlash(relativePath), "/") + 1
+	return depth > f.maxDepth
+}
+
+// Check whether a file has one of the included extensions
+func (f *fileFilter) includes(path string) bool {
+	if f == nil || len(f.includeExtensions) == 0 {
+		return true
+	}
+	return slices.Contains(f.includeExtensions, fileExtension(path))
+}
+
+// Parse a comma-separated list of extensions such as "log,.TXT" into the form fileExtension
+// returns, e.g. [".log", ".txt"]
+func ParseExtensions(list string) []string {
+	var extensions []string
+	for _, extension := range strings.Split(list, ",") {
+		extension = strings.ToLower(strings.TrimSpace(extension))
+		if extension == "" {
+			continue
+		}
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		extensions = append(extensions, extension)
+	}
+	return extensions
+}
+
+// Check whether path, relative to the scanned directory, matches any of the exclude patterns
+// The relative path always uses forward slashes so patterns behave the same on every OS
+// The scanned directory itself is never excluded
+func (f *fileFilter) excludes(directory, path string) bool {
+	if f == nil || (len(f.excludeRegex) == 0 && len(f.excludeGlobs) == 0) {
+		return false
+	}
+	relativePath, err := filepath.Rel(directory, path)
+	if err != nil || relativePath == "." {
+		return false
+	}
+	relativePath = filepath.ToSlash(relativePath)
+	for _, re := range f.excludeRegex {
+		if re.MatchString(relativePath) {
+			return true
+		}
+	}
+
+	name := filepath.Base(path)
+	if f.globFullPath {
+		name = relativePath
+	}
+	for _, pattern := range f.excludeGlobs {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
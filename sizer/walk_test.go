@@ -0,0 +1,163 @@
+package sizer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Collect what comes down a channel of listed files
+func collect(fileInfoChan <-chan FileInfo) []FileInfo {
+	var files []FileInfo
+	for file := range fileInfoChan {
+		files = append(files, file)
+	}
+	return files
+}
+
+func TestLimitStreamSize(t *testing.T) {
+	files := []FileInfo{{Path: "a", Size: 40}, {Path: "b", Size: 50}, {Path: "c", Size: 30}, {Path: "d", Size: 5}}
+	tests := []struct {
+		name      string
+		limit     int64
+		wantSizes []int64
+		wantPaths string
+		reported  []string
+	}{
+		{"no limit", 0, []int64{40, 50, 30, 5}, "abcd", nil},
+		{"above the total", 1000, []int64{40, 50, 30, 5}, "abcd", nil},
+		{"at the total", 125, []int64{40, 50, 30, 5}, "abcd", nil},
+		{"straddled", 100, []int64{40, 50, 10}, "abc", []string{"c is 30 bytes", "counting only its first 10", "skipping d"}},
+		{"at a file's end", 90, []int64{40, 50}, "ab", []string{"skipping c", "skipping d"}},
+		{"within the first file", 1, []int64{1}, "a", []string{"counting only its first 1", "skipping b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var errorLog strings.Builder
+			limited := collect(limitStreamSize(context.Background(), listed(files), test.limit, &errorLog))
+
+			paths := ""
+			var sizes []int64
+			for _, file := range limited {
+				paths += file.Path
+				sizes = append(sizes, file.Size)
+			}
+			if paths != test.wantPaths || len(sizes) != len(test.wantSizes) {
+				t.Fatalf("passed on %q with sizes %v, want %q with %v", paths, sizes, test.wantPaths, test.wantSizes)
+			}
+			for i := range sizes {
+				if sizes[i] != test.wantSizes[i] {
+					t.Errorf("passed on sizes %v, want %v", sizes, test.wantSizes)
+					break
+				}
+			}
+			for _, report := range test.reported {
+				if !strings.Contains(errorLog.String(), report) {
+					t.Errorf("the error log %q does not report %q", errorLog.String(), report)
+				}
+			}
+			if test.reported == nil && errorLog.Len() > 0 {
+				t.Errorf("unexpected errors: %s", errorLog.String())
+			}
+		})
+	}
+}
+
+func TestLimitStreamSizeHugeSizes(t *testing.T) {
+	// Sizes from a corrupt size index, which would overflow the offsets if added up
+	files := []FileInfo{{Path: "a", Size: MAX_STREAM_SIZE - 10}, {Path: "b", Size: MAX_STREAM_SIZE}, {Path: "c", Size: 1}}
+	var errorLog strings.Builder
+	limited := collect(limitStreamSize(context.Background(), listed(files), MAX_STREAM_SIZE, &errorLog))
+
+	total := int64(0)
+	for _, file := range limited {
+		total += file.Size
+	}
+	if len(limited) != 2 || total != MAX_STREAM_SIZE {
+		t.Errorf("passed on %d files totalling %d, want 2 totalling %d", len(limited), total, int64(MAX_STREAM_SIZE))
+	}
+}
+
+// List the directories as one, returning the paths listed relative to root, in order
+func listedPaths(t *testing.T, root string, directories []string, opts Options) []string {
+	t.Helper()
+	var errorLog strings.Builder
+	fileInfoChan := make(chan FileInfo)
+	go listDirectories(context.Background(), directories, opts.filter(), &errorLog, fileInfoChan)
+
+	var paths []string
+	for _, file := range collect(fileInfoChan) {
+		path, err := filepath.Rel(root, file.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.ToSlash(path))
+	}
+	if errorLog.Len() > 0 {
+		t.Errorf("unexpected errors: %s", errorLog.String())
+	}
+	return paths
+}
+
+func TestListDirectoriesListsEachFileOnce(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{"a", "sub/b", "sub/deeper/c", "other/d"} {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Symlinks to a directory and a file already in the tree
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "z-alias")); err != nil {
+		t.Fatal(err)
+	}
+	all := []string{"a", "other/d", "sub/b", "sub/deeper/c"}
+
+	tests := []struct {
+		name           string
+		directories    []string
+		followSymlinks bool
+		want           []string
+	}{
+		// A single directory without following symlinks is listed without a seen-set
+		{"one directory", []string{"."}, false, all},
+		{"the same directory twice", []string{".", "."}, false, all},
+		{"a directory and one inside it", []string{".", "sub"}, false, all},
+		{"a directory inside another first", []string{"sub/deeper", "."}, false, []string{"sub/deeper/c", "a", "other/d", "sub/b"}},
+		// With symlinks followed a single directory is listed with a seen-set too, and the files
+		// are listed under the first path they are found by
+		{"symlinks followed", []string{"."}, true, []string{"a", "link/b", "link/deeper/c", "other/d"}},
+		{"a directory and a symlink to it", []string{"sub", "link"}, true, []string{"sub/b", "sub/deeper/c"}},
+		{"symlinks followed in several directories", []string{"link", "."}, true, []string{"link/b", "link/deeper/c", "a", "other/d"}},
+	}
+	for _, test := range tests {
+		for _, concurrent := range []bool{false, true} {
+			name := test.name
+			if concurrent {
+				name += " concurrently"
+			}
+			t.Run(name, func(t *testing.T) {
+				opts := DefaultOptions()
+				opts.FollowSymlinks = test.followSymlinks
+				opts.ConcurrentWalk = concurrent
+				var directories []string
+				for _, directory := range test.directories {
+					directories = append(directories, filepath.Join(root, filepath.FromSlash(directory)))
+				}
+
+				if paths := listedPaths(t, root, directories, opts); !slices.Equal(paths, test.want) {
+					t.Errorf("listed %v, want %v", paths, test.want)
+				}
+			})
+		}
+	}
+}
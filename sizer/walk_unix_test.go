@@ -0,0 +1,125 @@
+//go:build unix
+
+package sizer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Run a listing or an estimate, failing the test if it does not finish in time, as it would if
+// it opened a named pipe that nothing writes to
+func withinTimeout(t *testing.T, run func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out, as reading a named pipe would")
+	}
+}
+
+func TestNamedPipesAreSkipped(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a": "some data", "sub/b": "more data"})
+	fifo := filepath.Join(root, "sub", "fifo")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Skipf("cannot make a named pipe: %v", err)
+	}
+	if err := os.Symlink(fifo, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	list := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(list, []byte(strings.Join([]string{filepath.Join(root, "a"), fifo, filepath.Join(root, "sub", "b")}, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		concurrent bool
+		follow     bool
+		filesFrom  string
+		skipped    []string
+	}{
+		{"walk", false, false, "", []string{fifo}},
+		{"concurrent walk", true, false, "", []string{fifo}},
+		{"walk following symlinks", false, true, "", []string{fifo, filepath.Join(root, "link")}},
+		{"concurrent walk following symlinks", true, true, "", []string{fifo, filepath.Join(root, "link")}},
+		{"file list", false, false, list, []string{fifo}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.ConcurrentWalk = test.concurrent
+			opts.FollowSymlinks = test.follow
+			opts.FilesFrom = test.filesFrom
+			var errorLog strings.Builder
+			opts.Errors = &errorLog
+
+			var files []FileInfo
+			withinTimeout(t, func() { files = collect(listFiles(context.Background(), []string{root}, opts)) })
+			if len(files) != 2 {
+				t.Errorf("listed %v, want a and sub/b", files)
+			}
+			for _, file := range files {
+				if file.Path == fifo {
+					t.Errorf("listed the named pipe %s", fifo)
+				}
+			}
+			for _, path := range test.skipped {
+				if !strings.Contains(errorLog.String(), "Skipping "+path+": not a regular file") {
+					t.Errorf("the error log %q does not report skipping %s", errorLog.String(), path)
+				}
+			}
+
+			// The estimate samples the files around the pipe without ever opening it
+			errorLog.Reset()
+			opts.SampleRatio = 1
+			var result Result
+			var err error
+			withinTimeout(t, func() { result, err = EstimateDirectories([]string{root}, opts) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Files != 2 || result.TotalSize != int64(len("some data")+len("more data")) {
+				t.Errorf("estimated %d bytes in %d files, want the 18 of a and sub/b", result.TotalSize, result.Files)
+			}
+		})
+	}
+}
+
+func TestCreateArchiveStopsWalkOnError(t *testing.T) {
+	// The archive cannot be written, so archiving fails on the first file; the walk would
+	// report the named pipe listed after the other files if it went on to the end
+	root := t.TempDir()
+	files := map[string]string{"a": string(compressibleData())}
+	for i := 0; i < 200; i++ {
+		files[fmt.Sprintf("b%03d", i)] = "some data"
+	}
+	writeTree(t, root, files)
+	fifo := filepath.Join(root, "z")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Skipf("cannot make a named pipe: %v", err)
+	}
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skipf("no /dev/full to fail writing the archive to: %v", err)
+	}
+
+	var errorLog strings.Builder
+	if _, err := createArchive(root, nil, &errorLog, "/dev/full", 0, "gzip", false); err == nil {
+		t.Fatal("writing the archive to a full device did not fail")
+	}
+	if strings.Contains(errorLog.String(), fifo) {
+		t.Errorf("the walk went on after archiving failed: %s", errorLog.String())
+	}
+}
@@ -1,289 +1,1858 @@
 package main
 
 import (
-	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
-
-	"github.com/dsnet/compress/bzip2"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/arunsupe/zip-sizer/sizer"
 )
 
+// Version of the tool, set at build time with e.g.
+// go build -ldflags "-X main.version=v0.3.0" -o bin/zip-sizer zip-sizer.go
+var version = "dev"
+
+// Exit codes, so that scripts can tell a failed estimate from one of an empty directory
 const (
-	CHUNKSIZE         = 10 * 1024 * 1024 // 10 MB
-	COMPRESSION_LEVEL = int(9)
+	EXIT_OK       = 0 // The estimate was made and printed
+	EXIT_USAGE    = 1 // The arguments are invalid
+	EXIT_ERROR    = 2 // Reading, compressing or writing the results failed
+	EXIT_NO_FILES = 3 // No data was found to estimate; the results are still printed
 )
 
-// FileInfo struct to hold file path and size
-type FileInfo struct {
-	Path string
-	Size int64
+// Estimates scaled up from samples of less than this fraction of the data they stand for
+// come with a warning
+const SMALL_SAMPLE_FRACTION = 0.001 // 0.1%
+
+// Samples smaller than this hold too little of the data for the compressor to find any
+// redundancy in, so the estimate would measure little but its headers
+const MIN_SAMPLE_SIZE = 64
+
+// Supported output formats
+var outputFormats = []string{"text", "json", "env", "csv", "ndjson", "prometheus"}
+
+// Ratio is a fraction that can be given on the command line as e.g. 0.1 or as a percentage, 10%
+type Ratio float64
+
+func (r *Ratio) UnmarshalText(text []byte) error {
+	number, percent := strings.CutSuffix(strings.TrimSpace(string(text)), "%")
+	value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil {
+		return fmt.Errorf("invalid ratio '%s'", text)
+	}
+	if percent {
+		value /= 100
+	}
+	*r = Ratio(value)
+	return nil
+}
+
+// ByteSize is a size in bytes that can be given on the command line as e.g. 4096, 512KB or 10MB
+// Units are binary, so 1KB is 1024 bytes, matching the sizes reported by --human-readable
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	size, err := parseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(size)
+	return nil
+}
+
+// Parse a size such as 4096, 512KB, 1.5G or 10MiB into bytes
+func parseByteSize(text string) (int64, error) {
+	text = strings.TrimSpace(text)
+	number := strings.TrimRightFunc(text, func(r rune) bool { return r < '0' || r > '9' })
+	unit := strings.ToUpper(strings.TrimSpace(text[len(number):]))
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", text)
+	}
+
+	multipliers := map[string]float64{
+		"": 1, "B": 1,
+		"K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+		"M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+		"G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+		"T": 1 << 40, "TB": 1 << 40, "TIB": 1 << 40,
+	}
+	multiplier, ok := multipliers[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit '%s'", unit)
+	}
+	return int64(value * multiplier), nil
+}
+
+// CommonArgs holds the flags every mode shares: what to scan, how to sample it and how to
+// print the result
+type CommonArgs struct {
+	Directories       []string `arg:"positional" help:"Directories to scan for files (paths, file:// URLs or glob patterns)"`
+	Combined          bool     `arg:"--combined" help:"Sample all directories as one concatenated stream and report a single estimate, as for one archive holding them all"`
+	NoGlob            bool     `arg:"--no-glob" help:"Do not expand glob patterns in the directory arguments, leaving that to the shell"`
+	Ratio             *Ratio   `arg:"-r,--sample-ratio" help:"Sample ratio for compression estimation, as a fraction (0.1) or a percentage (10%); defaults to 0.1"`
+	SampleRatio       Ratio    `arg:"-"` // --sample-ratio, or the fraction of a chunk --sample-size comes to
+	SampleSize        ByteSize `arg:"--sample-size" help:"Bytes to sample from every chunk (e.g. 1MB), in place of --sample-ratio"`
+	ChunkSize         ByteSize `arg:"-c,--chunk-size" help:"Distance between sample points (e.g. 10MB or 512KB); one sample is taken per chunk"`
+	Sampling          string   `arg:"--sampling" help:"Sampling mode: streaming samples in one pass, stratified lists the files first to spread the samples evenly over all of them, contiguous takes the whole sample as one run"`
+	Sort              string   `arg:"--sort" help:"Order to sample the files in: none (as they are found), name, size or mtime; any order but none lists every file first, so the estimate does not depend on the order the filesystem returns them in"`
+	HumanReadable     bool     `arg:"-u,--human-readable" help:"Display sizes in human-readable format"`
+	Both              bool     `arg:"--both" help:"Display sizes in bytes followed by the human-readable format"`
+	SI                bool     `arg:"--si" help:"Show human-readable sizes in decimal units (1 KB = 1000 bytes) instead of binary ones (1 KiB = 1024 bytes)"`
+	Verbose           bool     `arg:"-v,--verbose" help:"Log the files sampled, the number of samples and bytes read, and the compressed size of the samples to stderr"`
+	Progress          bool     `arg:"--progress" help:"Print the number of files and bytes scanned so far to stderr while scanning"`
+	Quiet             bool     `arg:"-q,--quiet" help:"Do not report files and directories that cannot be read while scanning"`
+	ExcludeRegex      []string `arg:"--exclude-regex,separate" help:"Skip files and directories whose relative path matches this regular expression (repeatable)"`
+	Exclude           []string `arg:"--exclude,separate" help:"Skip files and directories whose name matches this glob pattern, e.g. '*.jpg' (repeatable)"`
+	Include           string   `arg:"-i,--include" help:"Only estimate files with these extensions, as a comma-separated list (e.g. log,txt)"`
+	MaxDepth          int      `arg:"--max-depth" help:"Levels of subdirectories to descend into; 0 scans only the files directly in the directory, -1 has no limit"`
+	NoRecursion       bool     `arg:"--no-recursion" help:"Only estimate the files directly in the directory, skipping its subdirectories; the same as --max-depth 0"`
+	FollowSymlinks    bool     `arg:"--follow-symlinks" help:"Estimate the files and directories symlinks point to; by default symlinks are skipped"`
+	MinSize           ByteSize `arg:"--min-size" help:"Only estimate files of at least this size (e.g. 1MB)"`
+	MaxSize           ByteSize `arg:"--max-size" help:"Only estimate files of at most this size (e.g. 1GB)"`
+	Gitignore         bool     `arg:"--gitignore" help:"Skip files and directories that the .gitignore files in the directory ignore, as well as .git directories"`
+	OpenArchives      bool     `arg:"--open-archives" help:"Estimate the files stored in a .tar or .zip given as a directory, uncompressed, instead of the archive itself, to see what recompressing them would give"`
+	ConcurrentWalk    bool     `arg:"--concurrent-walk" help:"Read up to 16 directories at once while walking, for filesystems where every read is slow, such as network mounts"`
+	ExcludeFullPath   bool     `arg:"--exclude-full-path" help:"Match --exclude patterns against the path relative to the directory instead of the base name"`
+	SamplePlan        string   `arg:"--sample-plan" help:"JSON file listing the exact {offset, length} byte ranges of the concatenated stream to sample"`
+	DeltaFilter       bool     `arg:"--delta-filter" help:"Experimental: XOR-delta each file against its previous version (foo.1, foo.2, ...) before compressing"`
+	Env               bool     `arg:"--env" help:"Print the result as shell variable assignments (ZIPSIZER_ORIGINAL=...), for use with eval; same as --output env"`
+	Output            string   `arg:"-o,--output" help:"Output format: text, json, env, csv, ndjson (with --per-file) or prometheus"`
+	Hints             string   `arg:"--hints" help:"JSON file mapping path prefixes to the compression ratio to assume for files under them"`
+	Tar               bool     `arg:"--tar" help:"Estimate a compressed tar archive of the files, counting the tar headers and padding, rather than the files alone"`
+	CompressThreshold ByteSize `arg:"--compress-threshold" help:"Count files smaller than this (e.g. 4KB) at their original size, as archivers that skip compressing small files do"`
+	SkipCompressed    bool     `arg:"--skip-compressed" help:"Count already compressed files (.gz, .zip, .jpg, .mp4 and the like) at their original size instead of sampling them"`
+	CompressedExt     string   `arg:"--compressed-ext" help:"Extensions --skip-compressed treats as compressed, as a comma-separated list replacing the built-in one, or added to it with a leading + (e.g. +raw,dat)"`
+	Seed              *int64   `arg:"--seed" help:"Jitter each sample point within its chunk using this random seed; the same seed gives the same estimate"`
+	FilesFrom         string   `arg:"--files-from" help:"Read the paths of the files to estimate from this file, one per line, instead of walking a directory; '-' reads stdin"`
+	SizeIndex         string   `arg:"--size-index" help:"Read file sizes and paths from a listing (as made by find -printf '%s %p\\n') instead of walking a directory"`
+	CacheDir          string   `arg:"--cache-dir" help:"Keep estimates in this directory and reuse them while the settings and the files' sizes and modification times are unchanged"`
+	Timing            bool     `arg:"--timing" help:"Also report how long the estimate took, from the start of the walk"`
+	OutFile           string   `arg:"--out-file" help:"Write the results to this file, created or truncated, instead of stdout"`
+	DumpSample        string   `arg:"--dump-sample" help:"Also write the sampled bytes to this file, to inspect what the estimate was made from"`
+	ReadRetries       int      `arg:"--read-retries" help:"Retry a failed read of a file this many times, waiting longer each time, before skipping the rest of it"`
+	ShowConfig        bool     `arg:"--show-config" help:"Print every option as it will be used, defaults included, to stderr before running"`
 }
 
 // Args struct to hold command line arguments
+// Run without a subcommand, or with scan, zip-sizer takes every flag
 type Args struct {
-	Directory            string  `arg:"positional,required" help:"Directory to scan for files"`
-	CompressionLevel     int     `arg:"-l,--compression-level" help:"Compression level (1-9)"`
-	CompressionAlgorithm string  `arg:"-a,--compression-algorithm" help:"Compression algorithm (gzip or bzip2)"`
-	SampleRatio          float64 `arg:"-r,--sample-ratio" help:"Sample ratio for compression estimation"`
-	HumanReadable        bool    `arg:"-u,--human-readable" help:"Display sizes in human-readable format"`
-	Verbose              bool    `arg:"-v,--verbose" help:"Enable verbose output"`
+	CommonArgs
+	Level                *int          `arg:"-l,--compression-level" help:"Compression level (1-9, or 1-22 for zstd; 0 stores without compressing for gzip); defaults to the level the algorithm's own tool uses, 9 for gzip"`
+	CompressionLevel     int           `arg:"-"` // --compression-level, or the algorithm's default level
+	CompressionAlgorithm string        `arg:"-a,--compression-algorithm" help:"Compression algorithm (gzip, bzip2, zstd, xz, brotli, lz4 or snappy)"`
+	Workers              int           `arg:"-j,--workers" help:"Number of samples to compress in parallel, e.g. -j 8 to use 8 cores; 1 compresses the samples as one continuous stream"`
+	Adaptive             bool          `arg:"--adaptive" help:"Keep sampling until the running compression ratio stabilizes"`
+	Tolerance            float64       `arg:"--tolerance" help:"Relative ratio change between sample windows at which adaptive sampling stops"`
+	MaxSample            int64         `arg:"--max-sample" help:"Maximum bytes adaptive sampling may draw (0 for no limit)"`
+	AdaptiveRatio        bool          `arg:"--adaptive-ratio" help:"Pick the sample ratio: estimate at 1%, then double the ratio until two estimates in a row agree within 1%"`
+	Top                  int           `arg:"--top" help:"Also list the N largest files after the estimate, to see where the bytes are"`
+	BlockSize            ByteSize      `arg:"--block-size" help:"Also report the size on disk of the files, each rounded up to whole blocks of this size (e.g. 4KB)"`
+	Create               string        `arg:"--create" help:"After estimating, write a real compressed tar archive of the directory to this path and report its size"`
+	AgainstArchive       string        `arg:"--against-archive" help:"Estimate the size the directory would add to this existing archive, priming the compressor with its contents"`
+	Learn                string        `arg:"--learn" help:"File in which to record the average sampled ratio of each file extension across runs"`
+	UseLearned           bool          `arg:"--use-learned" help:"Use the ratios recorded with --learn instead of sampling files with a known extension"`
+	Breakdown            bool          `arg:"--breakdown" help:"Split the estimate into files that compress and files an archiver would store as is"`
+	ByExtension          bool          `arg:"--by-extension" help:"Also report the size, estimate and ratio of the files of each extension"`
+	Calibrate            bool          `arg:"--calibrate" help:"Check the estimates on generated data of known compressibility for every algorithm, then exit"`
+	ListAlgorithms       bool          `arg:"--list-algorithms" help:"List the supported compression algorithms with their levels, then exit"`
+	Dictionary           string        `arg:"--dictionary" help:"File of sample data to start the compressor from as a preset dictionary (gzip and zstd only)"`
+	EncryptThenCompress  bool          `arg:"--encrypt-then-compress" help:"Also estimate the size when the data is encrypted before being compressed, to show why the order matters"`
+	Compare              bool          `arg:"--compare" help:"Estimate with every compression algorithm on the same samples and print them side by side"`
+	PerFile              bool          `arg:"--per-file" help:"Estimate every file on its own and list them by estimated savings, largest first"`
+	DryRun               bool          `arg:"--dry-run" help:"List the files and print how much would be sampled, without reading or compressing anything"`
+	Sweep                bool          `arg:"--sweep" help:"Sample once, then compress the samples at every level of the algorithm and report the ratio and time of each, to pick a level"`
+	Repeat               int           `arg:"--repeat" help:"Sample once, then compress the samples this many times and report how long it took, to compare the CPU cost of algorithms and levels"`
+	MaxSampleMemory      ByteSize      `arg:"--max-sample-memory" help:"Keep the samples --sweep and --repeat reuse in a temporary file once they pass this size (0 for no limit)"`
+	Timeout              time.Duration `arg:"--timeout" help:"Stop scanning after this long (e.g. 30s or 5m) and report a partial estimate of the files listed by then"`
+}
+
+// CompareArgs holds the flags of the compare subcommand, which estimates with every
+// compression algorithm as --compare does
+type CompareArgs struct {
+	CommonArgs
+	Level   *int `arg:"-l,--compression-level" help:"Compression level (1-9, or 1-22 for zstd; 0 stores without compressing for gzip); defaults to the level the algorithm's own tool uses, 9 for gzip"`
+	Workers int  `arg:"-j,--workers" help:"Number of samples to compress in parallel, e.g. -j 8 to use 8 cores; 1 compresses the samples as one continuous stream"`
 }
 
-var totalSize int64
+// SweepArgs holds the flags of the sweep subcommand, which compresses the samples at every
+// level of the algorithm as --sweep does
+type SweepArgs struct {
+	CommonArgs
+	CompressionAlgorithm string   `arg:"-a,--compression-algorithm" help:"Compression algorithm (gzip, bzip2, zstd, xz, brotli, lz4 or snappy)"`
+	MaxSampleMemory      ByteSize `arg:"--max-sample-memory" help:"Keep the samples --sweep and --repeat reuse in a temporary file once they pass this size (0 for no limit)"`
+}
+
+// Commands are the subcommands, each running one mode with the flags that apply to it
+type Commands struct {
+	Scan    *Args        `arg:"subcommand:scan" help:"Estimate the compressed size of the directories, as zip-sizer without a subcommand does"`
+	Compare *CompareArgs `arg:"subcommand:compare" help:"Estimate with every compression algorithm on the same samples and print them side by side"`
+	Sweep   *SweepArgs   `arg:"subcommand:sweep" help:"Sample once, then compress the samples at every level of the algorithm and report the ratio and time of each"`
+}
 
-// List all files in a directory and send their sizes
-// Send it down a channel as it arrives
-// This is done to avoid loading all file sizes into memory at once
-func listFilesWithSizes(directory string, fileInfoChan chan<- FileInfo) {
-	defer close(fileInfoChan)
+// Names of the subcommands; a first argument that is not one of them is a directory
+var subcommands = []string{"scan", "compare", "sweep"}
 
-	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+// Where the results are printed: stdout, or the file given with --out-file
+var out io.Writer = os.Stdout
+
+// Why the scan was stopped before every file was listed, for the note on a partial estimate
+var stopReason string
+
+// Version is printed by --version
+func (Args) Version() string {
+	return "zip-sizer " + version
+}
+
+// Epilogue is printed at the end of --help
+func (Args) Epilogue() string {
+	return "Subcommands: scan (the default), compare and sweep; run zip-sizer compare --help or zip-sizer sweep --help for the flags of each"
+}
+
+func (Commands) Version() string {
+	return "zip-sizer " + version
+}
+
+// Resolve the directory argument to a local path
+// The argument may be a plain path or a URL; the URL scheme decides which backend reads it.
+// Plain paths and file:// URLs are read from the local filesystem, which is currently the
+// only backend
+func resolveDirectory(directory string) (string, error) {
+	if !strings.Contains(directory, "://") {
+		return directory, nil
+	}
+
+	u, err := url.Parse(directory)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "", "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return "", fmt.Errorf("file URL host must be empty or localhost, got '%s'", u.Host)
+		}
+		return filepath.FromSlash(u.Path), nil
+	default:
+		return "", fmt.Errorf("unsupported URL scheme '%s'", u.Scheme)
+	}
+}
+
+// Resolve the directory arguments to local paths, expanding glob patterns unless told not to
+// A glob pattern that matches nothing is an error, as is one that matches only files
+func expandDirectories(arguments []string, expandGlobs bool) ([]string, error) {
+	var directories []string
+	for _, argument := range arguments {
+		directory, err := resolveDirectory(argument)
 		if err != nil {
-			fmt.Printf("Error accessing path %s: %v\n", path, err)
-			return nil // Log the error and continue
+			return nil, fmt.Errorf("invalid directory '%s': %v", argument, err)
 		}
-		if !info.IsDir() {
-			fileInfoChan <- FileInfo{Path: path, Size: info.Size()}
+		if !expandGlobs || !strings.ContainsAny(directory, "*?[") {
+			directories = append(directories, directory)
+			continue
 		}
-		return nil
-	})
 
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		matches, err := filepath.Glob(directory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", argument, err)
+		}
+		matched := 0
+		for _, match := range matches {
+			if stat, err := os.Stat(match); err == nil && stat.IsDir() {
+				directories = append(directories, match)
+				matched++
+			}
+		}
+		if matched == 0 {
+			return nil, fmt.Errorf("pattern '%s' matched no directories", argument)
+		}
 	}
+	return directories, nil
 }
 
-// Sample sampleSize bytes from every chunkSize from the concatenated file stream
-// The basic idea is to pretend the files are a single large file and sample data from it
-// at regular intervals. This is done by calculating the offsets of the sampled data in the
-// concatenated file and then reading the data from the original files at those offsets.
-// Extract sampled data from the original files and write it to a pipe
-// This allows us to stream the sampled data without loading all files into memory at once
-func streamSampledData(fileInfoChan <-chan FileInfo, chunkSize, sampleSize int64, verbose bool) (io.Reader, error) {
-	sampledDataPipe, sampledDataWriter := io.Pipe()
+// Find two of the directories that hold the same files, because they are the same directory,
+// one is within the other or a symlink leads from one to the other
+func overlappingDirectories(directories []string) (string, string, bool) {
+	// Whether path is root or lies within it
+	within := func(path, root string) bool {
+		relativePath, err := filepath.Rel(root, path)
+		return err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator))
+	}
+	realPaths := make([]string, len(directories))
+	for i, directory := range directories {
+		absolutePath, err := filepath.Abs(directory)
+		if err != nil {
+			continue
+		}
+		if realPaths[i], err = filepath.EvalSymlinks(absolutePath); err != nil {
+			continue
+		}
+		for j, other := range realPaths[:i] {
+			if other != "" && (within(realPaths[i], other) || within(other, realPaths[i])) {
+				return directories[j], directory, true
+			}
+		}
+	}
+	return "", "", false
+}
 
-	go func() {
-		defer sampledDataWriter.Close()
+// Validate the command line arguments, returning the first problem found as the message to show
+func validateArgs(args Args) error {
+	if len(args.Directories) == 0 && !args.Calibrate && args.SizeIndex == "" && args.FilesFrom == "" {
+		return errors.New("At least one directory is required.")
+	}
+	// A size index replaces the directory walk
+	if args.SizeIndex != "" {
+		if len(args.Directories) > 0 || args.Create != "" {
+			return errors.New("A size index cannot be combined with directories or --create.")
+		}
+		if _, err := os.Stat(args.SizeIndex); err != nil {
+			return fmt.Errorf("Cannot read size index '%s'.", args.SizeIndex)
+		}
+	}
+	// So does a file list
+	if args.FilesFrom != "" {
+		if len(args.Directories) > 0 || args.Create != "" || args.SizeIndex != "" {
+			return errors.New("A file list cannot be combined with directories, --create or a size index.")
+		}
+		if _, err := os.Stat(args.FilesFrom); args.FilesFrom != "-" && err != nil {
+			return fmt.Errorf("Cannot read file list '%s'.", args.FilesFrom)
+		}
+	}
+	for _, directory := range args.Directories {
+		// A regular file is estimated on its own, as a directory holding only that file
+		if stat, err := os.Stat(directory); err != nil || !(stat.IsDir() || stat.Mode().IsRegular()) {
+			return fmt.Errorf("Provided path '%s' is not a directory or a regular file.", directory)
+		}
+	}
+	// A single archive can only be created from a single directory
+	if args.Create != "" && len(args.Directories) > 1 {
+		return errors.New("An archive can only be created from a single directory.")
+	}
+	// Directories estimated one by one would count the files they share twice in the total;
+	// the modes that sample them as one stream list each file once
+	if !args.Combined && !args.Compare && !args.Sweep && args.Repeat == 0 {
+		if first, second, ok := overlappingDirectories(args.Directories); ok {
+			return fmt.Errorf("'%s' and '%s' hold the same files, which would be counted twice in the total. Estimate them as one with --combined, which counts each file once.", first, second)
+		}
+	}
+
+	// A sample size sets the sample ratio instead, and takes up at most a whole chunk
+	if args.SampleSize != 0 && args.Ratio != nil {
+		return errors.New("--sample-size and --sample-ratio are mutually exclusive.")
+	}
+	if args.SampleSize < 0 || args.SampleSize > args.ChunkSize {
+		return errors.New("Sample size must be positive and at most the chunk size.")
+	}
+	if args.SampleSize != 0 && args.AdaptiveRatio {
+		return errors.New("An adaptive sample ratio cannot be combined with --sample-size.")
+	}
+	// Check if the sample ratio is valid
+	if args.SampleRatio <= 0 || args.SampleRatio > 1 {
+		return errors.New("Sample ratio must be between 0 and 1.")
+	}
+	// The size limits apply to the files found by walking a directory
+	if args.MinSize < 0 || args.MaxSize < 0 {
+		return errors.New("File size limits cannot be negative.")
+	}
+	if args.MaxSize > 0 && args.MaxSize < args.MinSize {
+		return errors.New("The maximum file size cannot be less than the minimum.")
+	}
+	if (args.MinSize > 0 || args.MaxSize > 0) && (args.SizeIndex != "" || args.FilesFrom != "") {
+		return errors.New("--min-size and --max-size cannot be combined with a size index or a file list.")
+	}
+	// .gitignore files are only found by walking a directory
+	if args.Gitignore && (args.SizeIndex != "" || args.FilesFrom != "") {
+		return errors.New("--gitignore cannot be combined with a size index or a file list.")
+	}
+	// The files stored in an archive are not on disk for the options that open them by path
+	if args.OpenArchives && (args.SizeIndex != "" || args.FilesFrom != "" || args.Create != "" || args.DeltaFilter) {
+		return errors.New("--open-archives cannot be combined with a size index, a file list, --create or --delta-filter.")
+	}
+	if args.ConcurrentWalk && (args.SizeIndex != "" || args.FilesFrom != "") {
+		return errors.New("--concurrent-walk cannot be combined with a size index or a file list.")
+	}
+	// Check if the maximum depth is valid
+	if args.MaxDepth < -1 {
+		return errors.New("Maximum depth must be -1 (no limit) or more.")
+	}
+	// --no-recursion sets the maximum depth itself
+	if args.NoRecursion && args.MaxDepth != -1 {
+		return errors.New("--no-recursion cannot be combined with --max-depth.")
+	}
+	// Check if the number of workers is valid
+	if args.Workers < 1 {
+		return errors.New("Number of workers must be at least 1.")
+	}
+	// Check if the chunk size leaves room for a sample
+	if args.ChunkSize <= 0 {
+		return errors.New("Chunk size must be positive.")
+	}
+	if sampleSize := int64(float64(args.ChunkSize) * float64(args.SampleRatio)); sampleSize < MIN_SAMPLE_SIZE {
+		if args.SampleSize > 0 {
+			return fmt.Errorf("Samples must be at least %d bytes to estimate from. Increase --sample-size.", MIN_SAMPLE_SIZE)
+		}
+		return fmt.Errorf("A sample ratio of %g of a %d byte chunk leaves samples too small to estimate from; they must be at least %d bytes. Increase --sample-ratio or --chunk-size.", args.SampleRatio, args.ChunkSize, MIN_SAMPLE_SIZE)
+	}
+	// Check if the compression algorithm is valid, and the level is in its range
+	if !slices.Contains(sizer.CompressionAlgorithms, args.CompressionAlgorithm) {
+		return fmt.Errorf("Compression algorithm must be one of: %s.", strings.Join(sizer.CompressionAlgorithms, ", "))
+	}
+	minLevel, maxLevel := sizer.MinCompressionLevel(args.CompressionAlgorithm), sizer.MaxCompressionLevel(args.CompressionAlgorithm)
+	if args.CompressionLevel < minLevel || args.CompressionLevel > maxLevel {
+		return fmt.Errorf("Compression level must be between %d and %d for %s.", minLevel, maxLevel, args.CompressionAlgorithm)
+	}
+	// Check if the adaptive sampling settings are valid
+	if args.Adaptive && (args.Tolerance <= 0 || args.MaxSample < 0) {
+		return errors.New("Tolerance must be positive and max sample must not be negative.")
+	}
+	// An adaptive sample ratio estimates the directories over and over, so nothing may happen
+	// once per estimate, and it needs sample points that grow with the ratio
+	if args.AdaptiveRatio && (args.Adaptive || args.SamplePlan != "" || args.Create != "" || args.Learn != "" || args.DumpSample != "" || args.PerFile || args.Compare || args.Repeat > 0 || args.Sweep || args.DryRun) {
+		return errors.New("An adaptive sample ratio cannot be combined with --adaptive, --sample-plan, --create, --learn, --dump-sample, --per-file, --compare, --repeat, --sweep or --dry-run.")
+	}
+	// Check if the existing archive can be read, and is not combined with adaptive sampling
+	if args.AgainstArchive != "" {
+		if _, err := os.Stat(args.AgainstArchive); err != nil {
+			return fmt.Errorf("Cannot read archive '%s'.", args.AgainstArchive)
+		}
+		if args.Adaptive {
+			return errors.New("Adaptive sampling cannot be combined with an existing archive.")
+		}
+	}
+	// Comparing encryption orders needs the plain compression path
+	if args.EncryptThenCompress && (args.Adaptive || args.AgainstArchive != "") {
+		return errors.New("Encrypt-then-compress cannot be combined with adaptive sampling or an existing archive.")
+	}
+	// Per-file estimates sample each file separately, which the stream-wide modes cannot do
+	if args.PerFile && (args.Adaptive || args.SamplePlan != "" || args.AgainstArchive != "" || args.EncryptThenCompress || args.Breakdown || args.Learn != "" || args.Create != "") {
+		return errors.New("Per-file estimates cannot be combined with --adaptive, --sample-plan, --against-archive, --encrypt-then-compress, --breakdown, --learn or --create.")
+	}
+	// Comparing algorithms compresses one set of samples with each algorithm in a single stream
+	if args.Compare && (args.Adaptive || args.AgainstArchive != "" || args.EncryptThenCompress || args.Breakdown || args.Learn != "" || args.Create != "" || args.PerFile) {
+		return errors.New("Comparing algorithms cannot be combined with --adaptive, --against-archive, --encrypt-then-compress, --breakdown, --learn, --create or --per-file.")
+	}
+	// A dry run only lists the files, so it can neither create an archive nor estimate files one by one
+	if args.DryRun && (args.Create != "" || args.PerFile) {
+		return errors.New("A dry run cannot be combined with --create or --per-file.")
+	}
+	// Timing runs compress the samples held in memory as one stream, with the chosen algorithm
+	// or, with --compare, every algorithm
+	if args.Repeat < 0 {
+		return errors.New("Repeat count cannot be negative.")
+	}
+	if args.Repeat > 0 && (args.Adaptive || args.AgainstArchive != "" || args.EncryptThenCompress || args.Breakdown || args.ByExtension || args.Learn != "" || args.Create != "" || args.PerFile || args.DryRun || args.Timeout > 0 || args.Workers > 1) {
+		return errors.New("Repeated timing runs cannot be combined with --adaptive, --against-archive, --encrypt-then-compress, --breakdown, --by-extension, --learn, --create, --per-file, --dry-run, --timeout or --workers.")
+	}
+	// A level sweep compresses the samples held in memory as one stream at every level of the
+	// chosen algorithm, timing each level as --repeat does
+	if args.Sweep && (args.Level != nil || !sizer.HasCompressionLevels(args.CompressionAlgorithm)) {
+		return errors.New("A level sweep tries every level of an algorithm with levels, so it cannot be combined with --compression-level or snappy.")
+	}
+	if args.Sweep && (args.Compare || args.Repeat > 0 || args.Adaptive || args.AgainstArchive != "" || args.EncryptThenCompress || args.Breakdown || args.ByExtension || args.Learn != "" || args.Create != "" || args.PerFile || args.DryRun || args.Timeout > 0 || args.Workers > 1) {
+		return errors.New("A level sweep cannot be combined with --compare, --repeat, --adaptive, --against-archive, --encrypt-then-compress, --breakdown, --by-extension, --learn, --create, --per-file, --dry-run, --timeout or --workers.")
+	}
+	// A dry run makes no estimate to time, --repeat has timings of its own, and CSV and the
+	// JSON of per-file estimates only list the estimates
+	if args.Timing && (args.DryRun || args.Repeat > 0 || args.Sweep || args.Output == "csv" || (args.PerFile && (args.Output == "json" || args.Output == "ndjson"))) {
+		return errors.New("Timing cannot be combined with --dry-run, --repeat, --sweep, CSV output or --per-file with JSON or NDJSON output.")
+	}
+	// A cached estimate skips sampling, so it can neither create an archive nor learn from or
+	// dump the samples, and the files are listed twice, which stdin does not allow
+	if args.CacheDir != "" && (args.Create != "" || args.Learn != "" || args.DumpSample != "" || args.FilesFrom == "-") {
+		return errors.New("The cache cannot be combined with --create, --learn, --dump-sample or a file list read from stdin.")
+	}
+	// Nothing is sampled in a dry run, so there is nothing to dump
+	if args.DumpSample != "" && args.DryRun {
+		return errors.New("Dumping the sample cannot be combined with --dry-run.")
+	}
+	if args.ReadRetries < 0 {
+		return errors.New("Read retries cannot be negative.")
+	}
+	// A timeout stops the scan of the single estimate stream; the other modes run to completion
+	if args.Timeout < 0 {
+		return errors.New("Timeout cannot be negative.")
+	}
+	// The largest files are kept while the estimate lists the files
+	if args.Top < 0 {
+		return errors.New("Number of largest files cannot be negative.")
+	}
+	if args.Top > 0 && (args.PerFile || args.Compare || args.DryRun || args.Repeat > 0 || args.Sweep) {
+		return errors.New("--top cannot be combined with --per-file, --compare, --dry-run, --repeat or --sweep.")
+	}
+	// The size on disk is added up while the estimate lists the files
+	if args.BlockSize > 0 && (args.PerFile || args.Compare || args.DryRun || args.Repeat > 0 || args.Sweep) {
+		return errors.New("--block-size cannot be combined with --per-file, --compare, --dry-run, --repeat or --sweep.")
+	}
+	if args.Timeout > 0 && (args.Compare || args.PerFile || args.DryRun || args.Create != "") {
+		return errors.New("A timeout cannot be combined with --compare, --per-file, --dry-run or --create.")
+	}
+	// The samples of each extension are compressed on their own, as part of a single stream
+	if args.ByExtension && (args.PerFile || args.Compare || args.AgainstArchive != "") {
+		return errors.New("Breaking the estimate down by extension cannot be combined with --per-file, --compare or --against-archive.")
+	}
+	// The tar headers belong to the archive as a whole, not to single files or extensions
+	if args.Tar && (args.PerFile || args.ByExtension) {
+		return errors.New("--tar cannot be combined with --per-file or --by-extension.")
+	}
+	// Custom compressed extensions only matter when skipping compressed files
+	if args.CompressedExt != "" && !args.SkipCompressed {
+		return errors.New("--compressed-ext requires --skip-compressed.")
+	}
+	// Only gzip and zstd can start from a dictionary, and only the main estimate is made with it
+	if args.Dictionary != "" {
+		if !sizer.SupportsDictionary(args.CompressionAlgorithm) {
+			return errors.New("--dictionary is only supported with gzip and zstd.")
+		}
+		if args.Compare || args.AgainstArchive != "" || args.EncryptThenCompress || args.Breakdown || args.ByExtension || args.Learn != "" || args.Create != "" {
+			return errors.New("--dictionary cannot be combined with --compare, --against-archive, --encrypt-then-compress, --breakdown, --by-extension, --learn or --create.")
+		}
+		if _, err := os.Stat(args.Dictionary); err != nil {
+			return fmt.Errorf("Cannot read dictionary '%s'.", args.Dictionary)
+		}
+	}
+	// Learned ratios can only be used from a learned ratio store
+	if args.UseLearned && args.Learn == "" {
+		return errors.New("Using learned ratios requires --learn <file>.")
+	}
+	// The delta filter works on computed sample points only
+	if args.DeltaFilter && args.SamplePlan != "" {
+		return errors.New("Delta filter cannot be combined with a sample plan.")
+	}
+	// A sample plan fixes every sample position, leaving nothing to jitter
+	if args.Seed != nil && args.SamplePlan != "" {
+		return errors.New("A seed cannot be combined with a sample plan.")
+	}
+	// Check if the sort order is valid; sorting waits for the whole listing, which a timeout cuts short
+	if !slices.Contains(sizer.SortOrders, args.Sort) {
+		return fmt.Errorf("Sort order must be one of: %s.", strings.Join(sizer.SortOrders, ", "))
+	}
+	if args.Sort != "none" && args.Timeout > 0 {
+		return errors.New("Sorting the files cannot be combined with --timeout.")
+	}
+	// Check if the sampling mode is valid, and whether its first pass can be made
+	if !slices.Contains(sizer.SamplingModes, args.Sampling) {
+		return fmt.Errorf("Sampling mode must be one of: %s.", strings.Join(sizer.SamplingModes, ", "))
+	}
+	if args.Sampling == "stratified" || args.Sampling == "contiguous" {
+		if args.SamplePlan != "" || args.DeltaFilter || args.PerFile {
+			return errors.New("Stratified and contiguous sampling cannot be combined with --sample-plan, --delta-filter or --per-file.")
+		}
+		if args.FilesFrom == "-" {
+			return errors.New("Stratified and contiguous sampling read the file list twice, so it cannot be read from stdin.")
+		}
+	}
+	// Check if the exclude regexes compile
+	for _, pattern := range args.ExcludeRegex {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("Invalid exclude regex '%s': %v", pattern, err)
+		}
+	}
+	// Check if the exclude globs are well formed
+	for _, pattern := range args.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid exclude pattern '%s': %v", pattern, err)
+		}
+	}
+	// Check if the output format is valid
+	if !slices.Contains(outputFormats, args.Output) {
+		return fmt.Errorf("Output format must be one of: %s.", strings.Join(outputFormats, ", "))
+	}
+	if args.Env && args.Output != "text" && args.Output != "env" {
+		return fmt.Errorf("--env cannot be combined with --output %s.", args.Output)
+	}
+	// CSV has one row per directory or file, which the side-by-side reports do not fit
+	if args.Output == "csv" && (args.Compare || args.DryRun || args.Repeat > 0 || args.Sweep) {
+		return errors.New("CSV output cannot be combined with --compare, --dry-run, --repeat or --sweep.")
+	}
+	// The metrics are gauges of the estimate of each directory
+	if args.Output == "prometheus" && (args.Compare || args.PerFile || args.DryRun || args.Repeat > 0 || args.Sweep) {
+		return errors.New("Prometheus output cannot be combined with --compare, --per-file, --dry-run, --repeat or --sweep.")
+	}
+	// NDJSON streams the estimates of single files as they are made
+	if args.Output == "ndjson" && !args.PerFile {
+		return errors.New("NDJSON output requires --per-file.")
+	}
 
-		totalSize = 0
-		currentOffset := int64(0)
-		nextSamplePoint := chunkSize - sampleSize // Initialize the first sample point
+	return nil
+}
 
-		for file := range fileInfoChan {
-			totalSize += file.Size
+// Print every option with the value it will be used with, under its long flag name, so that a
+// log shows what settings produced an estimate
+// The level is the resolved one, which is the algorithm's default when none was given, and so
+// is the sample ratio
+func printConfig(w io.Writer, args Args) {
+	args.Level = &args.CompressionLevel
+	args.Ratio = &args.SampleRatio
+	fmt.Fprintf(w, "Configuration:\n")
 
-			if nextSamplePoint >= currentOffset+file.Size {
-				currentOffset += file.Size
-				continue
+	values := reflect.ValueOf(args)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(args)) {
+		tag := field.Tag.Get("arg")
+		name := ""
+		for _, part := range strings.Split(tag, ",") {
+			if strings.HasPrefix(part, "--") {
+				name = part
+			} else if part == "positional" {
+				name = "directories"
 			}
+		}
+		if name == "" {
+			continue
+		}
 
-			// If verbose, print the file being processed
-			if verbose {
-				fmt.Printf("Sampling file: %s\n", file.Path)
-			}
-			f, err := os.Open(file.Path)
-			if err != nil {
-				sampledDataWriter.CloseWithError(err)
-				return
+		value := values.FieldByIndex(field.Index)
+		if value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				fmt.Fprintf(w, "  %s: (not set)\n", name)
+				continue
 			}
-			defer f.Close()
+			value = value.Elem()
+		}
+		fmt.Fprintf(w, "  %s: %v\n", name, value.Interface())
+	}
+}
 
-			for nextSamplePoint < currentOffset+file.Size {
-				relativeOffset := nextSamplePoint - currentOffset
-				if _, err := f.Seek(relativeOffset, io.SeekStart); err != nil {
-					sampledDataWriter.CloseWithError(err)
-					return
-				}
+// Convert bytes to human-readable format
+func convertToHumanReadable(size int64, decimal bool) string {
 
-				buf := make([]byte, sampleSize)
-				n, err := f.Read(buf)
-				if err != nil && err != io.EOF {
-					sampledDataWriter.CloseWithError(err)
-					return
-				}
+	sizeFloat := float64(size)
 
-				if n > 0 {
-					if _, err := sampledDataWriter.Write(buf[:n]); err != nil {
-						sampledDataWriter.CloseWithError(err)
-						return
-					}
-				}
+	// Binary units are powers of 1024 and labelled as such, as IEC prescribes
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	base := float64(1024)
+	if decimal {
+		units = []string{"B", "KB", "MB", "GB", "TB"}
+		base = 1000
+	}
+	index := 0
+	for sizeFloat >= base && index < len(units)-1 {
+		sizeFloat /= base
+		index++
+	}
+	return fmt.Sprintf("%.2f %s", float64(sizeFloat), units[index])
+}
 
-				nextSamplePoint += chunkSize
-			}
+// Format a size for the report: raw bytes, human-readable, or both side by side
+func formatSize(size int64, args Args) string {
+	switch {
+	case args.Both:
+		return fmt.Sprintf("%d bytes (%s)", size, convertToHumanReadable(size, args.SI))
+	case args.HumanReadable:
+		return convertToHumanReadable(size, args.SI)
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
 
-			currentOffset += file.Size
+// Work out how many bytes compressing saves and what percentage of the original size that is
+// Data that does not compress grows slightly, which gives a negative saving
+func savings(result sizer.Result) (int64, float64) {
+	saved := result.TotalSize - result.EstimatedCompressedSize
+	if result.TotalSize == 0 {
+		return saved, 0
+	}
+	return saved, float64(saved) / float64(result.TotalSize) * 100
+}
+
+// Print the result as the usual human-oriented report
+func printTextResult(result sizer.Result, args Args) {
+	if result.TotalSize == 0 {
+		fmt.Fprintf(out, "No data to sample: no files with any contents were found.\n")
+		return
+	}
+	if result.Partial {
+		fmt.Fprintf(out, "Note: %s, so this estimate only covers the files listed by then.\n", stopReason)
+	}
+	fmt.Fprintf(out, "Total original size: %s\n", formatSize(result.TotalSize, args))
+	if args.BlockSize > 0 {
+		fmt.Fprintf(out, "Size on disk: %s\n", formatSize(result.DiskSize, args))
+	}
+	fmt.Fprintf(out, "Files scanned: %d\n", result.Files)
+	if args.AgainstArchive != "" {
+		fmt.Fprintf(out, "Estimated size added to archive: %s\n", formatSize(result.EstimatedCompressedSize, args))
+	} else {
+		fmt.Fprintf(out, "Estimated compressed size: %s\n", formatSize(result.EstimatedCompressedSize, args))
+	}
+	fmt.Fprintf(out, "Compression ratio: %.4f\n", result.Ratio)
+	if saved, percent := savings(result); saved >= 0 {
+		fmt.Fprintf(out, "Estimated savings: %s (%.1f%%)\n", formatSize(saved, args), percent)
+	} else {
+		fmt.Fprintf(out, "Estimated savings: none, compressing adds %s (%.1f%%)\n", formatSize(-saved, args), -percent)
+	}
+	if result.HasConfidence {
+		low, high := confidenceInterval(result)
+		fmt.Fprintf(out, "95%% confidence interval: %s - %s\n", formatSize(low, args), formatSize(high, args))
+	}
+	if args.Adaptive {
+		fmt.Fprintf(out, "Sampled to converge: %s\n", formatSize(result.SampledBytes, args))
+	}
+	if args.AdaptiveRatio {
+		fmt.Fprintf(out, "Sample ratio used: %.4f\n", result.SampleRatio)
+	}
+	if args.CompressThreshold > 0 {
+		fmt.Fprintf(out, "Files stored below threshold: %d\n", result.FilesBelowThreshold)
+	}
+	if args.EncryptThenCompress {
+		fmt.Fprintf(out, "Estimated size if encrypted before compressing: %s\n", formatSize(result.EncryptedFirstSize, args))
+		if result.TotalSize > 0 {
+			fmt.Fprintf(out, "Compress-then-encrypt ratio: %.4f\n", result.Ratio)
+			fmt.Fprintf(out, "Encrypt-then-compress ratio: %.4f\n", float64(result.EncryptedFirstSize)/float64(result.TotalSize))
 		}
-	}()
+	}
+	if args.Breakdown {
+		fmt.Fprintf(out, "Compressed portion: %s\n", formatSize(result.CompressedPortion, args))
+		fmt.Fprintf(out, "Stored portion: %s\n", formatSize(result.StoredPortion, args))
+	}
+	if args.ByExtension {
+		printExtensionResults(result.Extensions, args)
+	}
+	if args.Create != "" && !result.Partial {
+		fmt.Fprintf(out, "Actual compressed size: %s\n", formatSize(result.ActualCompressedSize, args))
+		if result.ActualCompressedSize > 0 {
+			estimateError := float64(result.EstimatedCompressedSize-result.ActualCompressedSize) / float64(result.ActualCompressedSize) * 100
+			fmt.Fprintf(out, "Estimate error: %+.2f%%\n", estimateError)
+		}
+	}
+	if args.Top > 0 {
+		fmt.Fprintf(out, "Largest files:\n")
+		for _, file := range largestFiles(result, args) {
+			fmt.Fprintf(out, "  %s: %s\n", file.Path, formatSize(file.Size, args))
+		}
+	}
+	if args.Timing {
+		fmt.Fprintf(out, "Elapsed: %s\n", result.Elapsed.Round(time.Millisecond))
+	}
+}
 
-	return sampledDataPipe, nil
+// The --top largest files of a result, largest first; a sum of results holds those of every
+// directory
+func largestFiles(result sizer.Result, args Args) []sizer.FileInfo {
+	files := slices.Clone(result.LargestFiles)
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+	return files[:min(len(files), args.Top)]
 }
 
-// Compress data using a specified compression writer (supports gzip and bzip2)
-// compress the data from the sampled data stream, not saving the compressed data; just the compressed size
-// The compression ratio is calculated as the size of the compressed data divided by the size of the uncompressed data
-// The function returns the compression ratio as a float64
-func compressData(uncompressedInput io.Reader, compressionLevel int, compressionAlgorithm string) (float64, error) {
-	compressedSize := float64(0)
-	uncompressedSize := float64(0)
+// A metric of --output prometheus
+type prometheusMetric struct {
+	name, help string
+	value      func(sizer.Result) float64
+}
 
-	// Create a pipe to stream the compressed data
-	// Write compressed data directly into the pipe
-	// Read the compressed data size from the other end
-	compressedDataPipe, compressedDataWriter := io.Pipe()
+// The metrics of --output prometheus, in the order they are printed
+var prometheusMetrics = []prometheusMetric{
+	{"zipsizer_total_bytes", "Total size of the files estimated, in bytes.", func(result sizer.Result) float64 { return float64(result.TotalSize) }},
+	{"zipsizer_estimated_bytes", "Estimated compressed size of the files, in bytes.", func(result sizer.Result) float64 { return float64(result.EstimatedCompressedSize) }},
+	{"zipsizer_ratio", "Estimated compressed size over total size.", func(result sizer.Result) float64 { return result.Ratio }},
+	{"zipsizer_files", "Number of files estimated.", func(result sizer.Result) float64 { return float64(result.Files) }},
+	{"zipsizer_partial", "1 if the scan was stopped before all the files were listed, 0 otherwise.", func(result sizer.Result) float64 {
+		if result.Partial {
+			return 1
+		}
+		return 0
+	}},
+}
 
-	go func() {
-		var writer io.WriteCloser
-		var err error
+// Print the estimates in the Prometheus text exposition format, e.g. for the textfile collector
+// of node_exporter
+// Every metric is a gauge with one sample per directory, or a single one for the directories
+// combined, labelled with the directory, algorithm and level; sizes are always raw bytes
+func printPrometheus(results []sizer.Result, args Args) {
+	labels := make([]string, len(results))
+	for i := range results {
+		directory := strings.Join(args.Directories, " ")
+		if !args.Combined {
+			directory = args.Directories[i]
+		}
+		labels[i] = fmt.Sprintf(`directory="%s",algorithm="%s",level="%d"`, prometheusLabel(directory), prometheusLabel(args.CompressionAlgorithm), args.CompressionLevel)
+	}
 
-		// Set the compression algorithm and level
-		switch compressionAlgorithm {
-		case "bzip2":
-			writer, err = bzip2.NewWriter(compressedDataWriter, &bzip2.WriterConfig{Level: compressionLevel}) // Requires "github.com/dsnet/compress/bzip2"
-			if err != nil {
-				compressedDataWriter.CloseWithError(err)
-				return
-			}
-		default: // Default to gzip
-			writer, err = gzip.NewWriterLevel(compressedDataWriter, compressionLevel)
-			if err != nil {
-				compressedDataWriter.CloseWithError(err)
-				return
-			}
+	metrics := prometheusMetrics
+	if args.Timing {
+		metrics = append(slices.Clone(metrics), prometheusMetric{"zipsizer_elapsed_seconds", "Time taken by the estimate, in seconds.", func(result sizer.Result) float64 { return result.Elapsed.Seconds() }})
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(out, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(out, "# TYPE %s gauge\n", metric.name)
+		for i, result := range results {
+			fmt.Fprintf(out, "%s{%s} %s\n", metric.name, labels[i], strconv.FormatFloat(metric.value(result), 'f', -1, 64))
 		}
+	}
+}
 
-		defer writer.Close()
-		defer compressedDataWriter.Close()
+// Escape a label value for the Prometheus text format
+func prometheusLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
 
-		buf := make([]byte, 4096)
-		for {
-			// Read from the uncompressed input stream into the buffer
-			n, err := uncompressedInput.Read(buf)
-			if n > 0 {
-				// keep track of the uncompressed size (to calculate the compression ratio)
-				uncompressedSize += float64(n)
-				if _, err := writer.Write(buf[:n]); err != nil {
-					compressedDataWriter.CloseWithError(err)
-					return
-				}
-			}
-			if err == io.EOF {
-				break
+// Print the estimates as CSV, one row per directory or file, e.g. for a spreadsheet
+// Sizes are always raw bytes
+func printCSV(rows []sizer.FileResult) error {
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"path", "original_size", "estimated_size", "ratio"})
+	for _, row := range rows {
+		writer.Write([]string{
+			row.Path,
+			strconv.FormatInt(row.TotalSize, 10),
+			strconv.FormatInt(row.EstimatedCompressedSize, 10),
+			strconv.FormatFloat(row.Ratio, 'f', 6, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Print the result as shell variable assignments, e.g. eval $(zip-sizer --env <directory>)
+// Sizes are always raw bytes so they can be used directly in shell arithmetic
+func printEnvResult(result sizer.Result, args Args) {
+	fmt.Fprintf(out, "ZIPSIZER_ORIGINAL=%d\n", result.TotalSize)
+	if args.BlockSize > 0 {
+		fmt.Fprintf(out, "ZIPSIZER_DISK_SIZE=%d\n", result.DiskSize)
+	}
+	fmt.Fprintf(out, "ZIPSIZER_FILES=%d\n", result.Files)
+	fmt.Fprintf(out, "ZIPSIZER_ESTIMATED=%d\n", result.EstimatedCompressedSize)
+	fmt.Fprintf(out, "ZIPSIZER_RATIO=%.6f\n", result.Ratio)
+	saved, percent := savings(result)
+	fmt.Fprintf(out, "ZIPSIZER_SAVINGS=%d\n", saved)
+	fmt.Fprintf(out, "ZIPSIZER_SAVINGS_PERCENT=%.2f\n", percent)
+	if result.HasConfidence {
+		low, high := confidenceInterval(result)
+		fmt.Fprintf(out, "ZIPSIZER_CONFIDENCE_LOW=%d\n", low)
+		fmt.Fprintf(out, "ZIPSIZER_CONFIDENCE_HIGH=%d\n", high)
+	}
+	if args.Adaptive {
+		fmt.Fprintf(out, "ZIPSIZER_SAMPLED=%d\n", result.SampledBytes)
+	}
+	if args.AdaptiveRatio {
+		fmt.Fprintf(out, "ZIPSIZER_SAMPLE_RATIO=%.6f\n", result.SampleRatio)
+	}
+	if args.CompressThreshold > 0 {
+		fmt.Fprintf(out, "ZIPSIZER_BELOW_THRESHOLD=%d\n", result.FilesBelowThreshold)
+	}
+	if args.EncryptThenCompress {
+		fmt.Fprintf(out, "ZIPSIZER_ENCRYPTED_FIRST=%d\n", result.EncryptedFirstSize)
+	}
+	if args.Breakdown {
+		fmt.Fprintf(out, "ZIPSIZER_COMPRESSED_PORTION=%d\n", result.CompressedPortion)
+		fmt.Fprintf(out, "ZIPSIZER_STORED_PORTION=%d\n", result.StoredPortion)
+	}
+	if args.Create != "" {
+		fmt.Fprintf(out, "ZIPSIZER_ACTUAL=%d\n", result.ActualCompressedSize)
+	}
+	if result.Partial {
+		fmt.Fprintf(out, "ZIPSIZER_PARTIAL=1\n")
+	}
+	if args.Timing {
+		fmt.Fprintf(out, "ZIPSIZER_ELAPSED=%.3f\n", result.Elapsed.Seconds())
+	}
+}
+
+// A result as printed with --output json
+// Sizes are always raw bytes; the optional fields are only present when the matching option is used
+type jsonResult struct {
+	Directory               string                           `json:"directory,omitempty"`
+	TotalOriginalSize       int64                            `json:"total_original_size"`
+	DiskSize                *int64                           `json:"disk_size,omitempty"`
+	Files                   int64                            `json:"files"`
+	EstimatedCompressedSize int64                            `json:"estimated_compressed_size"`
+	CompressionRatio        float64                          `json:"compression_ratio"`
+	Savings                 int64                            `json:"savings"`
+	SavingsPercent          float64                          `json:"savings_percent"`
+	Algorithm               string                           `json:"algorithm"`
+	Level                   int                              `json:"level"`
+	SampleRatio             float64                          `json:"sample_ratio"`
+	SampledUncompressed     int64                            `json:"sampled_uncompressed_bytes"`
+	SampledCompressed       int64                            `json:"sampled_compressed_bytes"`
+	ScaleFactor             float64                          `json:"scale_factor"`
+	SampledBytes            *int64                           `json:"sampled_bytes,omitempty"`
+	FilesBelowThreshold     *int64                           `json:"files_below_threshold,omitempty"`
+	EncryptedFirstSize      *int64                           `json:"encrypted_first_size,omitempty"`
+	CompressedPortion       *int64                           `json:"compressed_portion,omitempty"`
+	StoredPortion           *int64                           `json:"stored_portion,omitempty"`
+	ActualCompressedSize    *int64                           `json:"actual_compressed_size,omitempty"`
+	ConfidenceLow           *int64                           `json:"confidence_low,omitempty"`
+	ConfidenceHigh          *int64                           `json:"confidence_high,omitempty"`
+	Extensions              map[string]sizer.ExtensionResult `json:"extensions,omitempty"`
+	LargestFiles            []jsonFile                       `json:"largest_files,omitempty"`
+	Partial                 bool                             `json:"partial,omitempty"`
+	ElapsedSeconds          *float64                         `json:"elapsed_seconds,omitempty"`
+	Directories             []jsonResult                     `json:"directories,omitempty"`
+}
+
+// A file of the largest files list in JSON form
+type jsonFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Convert a result to its JSON form
+func newJSONResult(result sizer.Result, args Args) jsonResult {
+	converted := jsonResult{
+		TotalOriginalSize:       result.TotalSize,
+		Files:                   result.Files,
+		EstimatedCompressedSize: result.EstimatedCompressedSize,
+		CompressionRatio:        result.Ratio,
+		Algorithm:               args.CompressionAlgorithm,
+		Level:                   args.CompressionLevel,
+		SampleRatio:             float64(args.SampleRatio),
+		SampledUncompressed:     result.SampledUncompressedBytes,
+		SampledCompressed:       result.SampledCompressedBytes,
+		ScaleFactor:             result.ScaleFactor,
+		Partial:                 result.Partial,
+	}
+	converted.Savings, converted.SavingsPercent = savings(result)
+	if args.BlockSize > 0 {
+		converted.DiskSize = &result.DiskSize
+	}
+	if args.AdaptiveRatio {
+		converted.SampleRatio = result.SampleRatio
+	}
+	if args.Adaptive {
+		converted.SampledBytes = &result.SampledBytes
+	}
+	if args.CompressThreshold > 0 {
+		converted.FilesBelowThreshold = &result.FilesBelowThreshold
+	}
+	if args.EncryptThenCompress {
+		converted.EncryptedFirstSize = &result.EncryptedFirstSize
+	}
+	if args.Breakdown {
+		converted.CompressedPortion = &result.CompressedPortion
+		converted.StoredPortion = &result.StoredPortion
+	}
+	if args.Create != "" {
+		converted.ActualCompressedSize = &result.ActualCompressedSize
+	}
+	if result.HasConfidence {
+		low, high := confidenceInterval(result)
+		converted.ConfidenceLow, converted.ConfidenceHigh = &low, &high
+	}
+	if args.Timing {
+		elapsed := result.Elapsed.Seconds()
+		converted.ElapsedSeconds = &elapsed
+	}
+	if args.ByExtension {
+		converted.Extensions = make(map[string]sizer.ExtensionResult, len(result.Extensions))
+		for extension, extensionResult := range result.Extensions {
+			converted.Extensions[extensionName(extension)] = extensionResult
+		}
+	}
+	for _, file := range largestFiles(result, args) {
+		converted.LargestFiles = append(converted.LargestFiles, jsonFile{Path: file.Path, Size: file.Size})
+	}
+	return converted
+}
+
+// Print the results as a single JSON object describing the total
+// With several directories the object also lists the result of each directory
+func printJSONResult(results []sizer.Result, args Args) error {
+	output := newJSONResult(sumResults(results), args)
+	if len(results) > 1 {
+		for i, result := range results {
+			directoryResult := newJSONResult(result, args)
+			directoryResult.Directory = args.Directories[i]
+			output.Directories = append(output.Directories, directoryResult)
+		}
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
+
+// Print the estimates of every algorithm compared, in the order of CompressionAlgorithms
+func printComparison(results map[string]sizer.Result, args Args) error {
+	var algorithms []string
+	for _, algorithm := range sizer.CompressionAlgorithms {
+		if _, ok := results[algorithm]; ok {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+
+	switch args.Output {
+	case "env":
+		fmt.Fprintf(out, "ZIPSIZER_ORIGINAL=%d\n", results[algorithms[0]].TotalSize)
+		fmt.Fprintf(out, "ZIPSIZER_FILES=%d\n", results[algorithms[0]].Files)
+		for _, algorithm := range algorithms {
+			name := strings.ToUpper(algorithm)
+			fmt.Fprintf(out, "ZIPSIZER_ESTIMATED_%s=%d\n", name, results[algorithm].EstimatedCompressedSize)
+			fmt.Fprintf(out, "ZIPSIZER_RATIO_%s=%.6f\n", name, results[algorithm].Ratio)
+		}
+		if args.Timing {
+			fmt.Fprintf(out, "ZIPSIZER_ELAPSED=%.3f\n", results[algorithms[0]].Elapsed.Seconds())
+		}
+	case "json":
+		output := make([]jsonResult, 0, len(algorithms))
+		for _, algorithm := range algorithms {
+			algorithmArgs := args
+			algorithmArgs.CompressionAlgorithm = algorithm
+			output = append(output, newJSONResult(results[algorithm], algorithmArgs))
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	default:
+		if results[algorithms[0]].TotalSize == 0 {
+			fmt.Fprintf(out, "No data to sample: no files with any contents were found.\n")
+			return nil
+		}
+		fmt.Fprintf(out, "Total original size: %s\n", formatSize(results[algorithms[0]].TotalSize, args))
+		fmt.Fprintf(out, "Files scanned: %d\n", results[algorithms[0]].Files)
+		fmt.Fprintf(out, "%-9s %-30s %s\n", "Algorithm", "Estimated compressed size", "Ratio")
+		for _, algorithm := range algorithms {
+			fmt.Fprintf(out, "%-9s %-30s %.4f\n", algorithm, formatSize(results[algorithm].EstimatedCompressedSize, args), results[algorithm].Ratio)
+		}
+		if args.Timing {
+			fmt.Fprintf(out, "Elapsed: %s\n", results[algorithms[0]].Elapsed.Round(time.Millisecond))
+		}
+	}
+	return nil
+}
+
+// Print the timing runs of each algorithm, in the order of sizer.CompressionAlgorithms
+func printBenchmark(results map[string]sizer.BenchmarkResult, args Args) error {
+	var algorithms []string
+	for _, algorithm := range sizer.CompressionAlgorithms {
+		if _, ok := results[algorithm]; ok {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	first := results[algorithms[0]]
+
+	switch args.Output {
+	case "env":
+		fmt.Fprintf(out, "ZIPSIZER_ORIGINAL=%d\n", first.TotalSize)
+		fmt.Fprintf(out, "ZIPSIZER_FILES=%d\n", first.Files)
+		fmt.Fprintf(out, "ZIPSIZER_SAMPLED=%d\n", first.SampledBytes)
+		fmt.Fprintf(out, "ZIPSIZER_RUNS=%d\n", first.Runs)
+		for _, algorithm := range algorithms {
+			name := strings.ToUpper(algorithm)
+			fmt.Fprintf(out, "ZIPSIZER_ESTIMATED_%s=%d\n", name, results[algorithm].EstimatedCompressedSize)
+			fmt.Fprintf(out, "ZIPSIZER_RATIO_%s=%.6f\n", name, results[algorithm].Ratio)
+			fmt.Fprintf(out, "ZIPSIZER_MIN_SECONDS_%s=%.6f\n", name, results[algorithm].MinTime.Seconds())
+			fmt.Fprintf(out, "ZIPSIZER_MEAN_SECONDS_%s=%.6f\n", name, results[algorithm].MeanTime.Seconds())
+		}
+	case "json":
+		type jsonBenchmark struct {
+			jsonResult
+			Runs        int     `json:"runs"`
+			MinSeconds  float64 `json:"min_seconds"`
+			MeanSeconds float64 `json:"mean_seconds"`
+			MaxSeconds  float64 `json:"max_seconds"`
+		}
+		output := make([]jsonBenchmark, 0, len(algorithms))
+		for _, algorithm := range algorithms {
+			result := results[algorithm]
+			algorithmArgs := args
+			algorithmArgs.CompressionAlgorithm = algorithm
+			converted := newJSONResult(result.Result, algorithmArgs)
+			converted.SampledBytes = &result.SampledBytes
+			output = append(output, jsonBenchmark{
+				jsonResult:  converted,
+				Runs:        result.Runs,
+				MinSeconds:  result.MinTime.Seconds(),
+				MeanSeconds: result.MeanTime.Seconds(),
+				MaxSeconds:  result.MaxTime.Seconds(),
+			})
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	default:
+		if first.TotalSize == 0 {
+			fmt.Fprintf(out, "No data to sample: no files with any contents were found.\n")
+			return nil
+		}
+		fmt.Fprintf(out, "Total original size: %s\n", formatSize(first.TotalSize, args))
+		fmt.Fprintf(out, "Files scanned: %d\n", first.Files)
+		fmt.Fprintf(out, "Sampled: %s, compressed %d times\n", formatSize(first.SampledBytes, args), first.Runs)
+		fmt.Fprintf(out, "%-9s %-30s %-8s %-12s %-12s %-12s %s\n", "Algorithm", "Estimated compressed size", "Ratio", "Min", "Mean", "Max", "Throughput")
+		for _, algorithm := range algorithms {
+			result := results[algorithm]
+			throughput := "-"
+			if result.MeanTime > 0 {
+				throughput = formatSize(int64(float64(result.SampledBytes)/result.MeanTime.Seconds()), args) + "/s"
 			}
-			if err != nil {
-				compressedDataWriter.CloseWithError(err)
-				return
+			fmt.Fprintf(out, "%-9s %-30s %-8.4f %-12s %-12s %-12s %s\n", algorithm, formatSize(result.EstimatedCompressedSize, args), result.Ratio,
+				result.MinTime.Round(time.Microsecond), result.MeanTime.Round(time.Microsecond), result.MaxTime.Round(time.Microsecond), throughput)
+		}
+	}
+	return nil
+}
+
+// Print the estimate and compression time at every level of a sweep, lowest level first
+func printSweep(results []sizer.LevelResult, args Args) error {
+	first := results[0]
+
+	switch args.Output {
+	case "env":
+		fmt.Fprintf(out, "ZIPSIZER_ORIGINAL=%d\n", first.TotalSize)
+		fmt.Fprintf(out, "ZIPSIZER_FILES=%d\n", first.Files)
+		fmt.Fprintf(out, "ZIPSIZER_SAMPLED=%d\n", first.SampledBytes)
+		for _, result := range results {
+			fmt.Fprintf(out, "ZIPSIZER_ESTIMATED_LEVEL_%d=%d\n", result.Level, result.EstimatedCompressedSize)
+			fmt.Fprintf(out, "ZIPSIZER_RATIO_LEVEL_%d=%.6f\n", result.Level, result.Ratio)
+			fmt.Fprintf(out, "ZIPSIZER_SECONDS_LEVEL_%d=%.6f\n", result.Level, result.Time.Seconds())
+		}
+	case "json":
+		type jsonLevel struct {
+			jsonResult
+			Seconds float64 `json:"seconds"`
+		}
+		output := make([]jsonLevel, 0, len(results))
+		for _, result := range results {
+			levelArgs := args
+			levelArgs.CompressionLevel = result.Level
+			converted := newJSONResult(result.Result, levelArgs)
+			converted.SampledBytes = &result.SampledBytes
+			output = append(output, jsonLevel{jsonResult: converted, Seconds: result.Time.Seconds()})
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	default:
+		if first.TotalSize == 0 {
+			fmt.Fprintf(out, "No data to sample: no files with any contents were found.\n")
+			return nil
+		}
+		fmt.Fprintf(out, "Total original size: %s\n", formatSize(first.TotalSize, args))
+		fmt.Fprintf(out, "Files scanned: %d\n", first.Files)
+		fmt.Fprintf(out, "Sampled: %s, compressed with %s\n", formatSize(first.SampledBytes, args), args.CompressionAlgorithm)
+		fmt.Fprintf(out, "%-6s %-30s %-8s %-12s %s\n", "Level", "Estimated compressed size", "Ratio", "Time", "Throughput")
+		for _, result := range results {
+			throughput := "-"
+			if result.Time > 0 {
+				throughput = formatSize(int64(float64(result.SampledBytes)/result.Time.Seconds()), args) + "/s"
 			}
+			fmt.Fprintf(out, "%-6d %-30s %-8.4f %-12s %s\n", result.Level, formatSize(result.EstimatedCompressedSize, args), result.Ratio,
+				result.Time.Round(time.Microsecond), throughput)
 		}
-	}()
+	}
+	return nil
+}
 
-	buf := make([]byte, 4096)
-	for {
-		n, err := compressedDataPipe.Read(buf)
-		compressedSize += float64(n)
+// Print what a dry run found would be sampled
+func printSchedule(schedule sizer.SampleSchedule, args Args) error {
+	sampledPercent := float64(0)
+	if schedule.TotalSize > 0 {
+		sampledPercent = float64(schedule.SampledBytes) / float64(schedule.TotalSize) * 100
+	}
 
-		if err == io.EOF {
-			break
+	switch args.Output {
+	case "env":
+		fmt.Fprintf(out, "ZIPSIZER_ORIGINAL=%d\n", schedule.TotalSize)
+		fmt.Fprintf(out, "ZIPSIZER_FILES=%d\n", schedule.Files)
+		fmt.Fprintf(out, "ZIPSIZER_SAMPLE_SIZE=%d\n", schedule.SampleSize)
+		fmt.Fprintf(out, "ZIPSIZER_SAMPLE_POINTS=%d\n", schedule.SamplePoints)
+		fmt.Fprintf(out, "ZIPSIZER_SAMPLED_FILES=%d\n", schedule.SampledFiles)
+		fmt.Fprintf(out, "ZIPSIZER_SAMPLED=%d\n", schedule.SampledBytes)
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			TotalOriginalSize int64   `json:"total_original_size"`
+			Files             int64   `json:"files"`
+			SampleSize        int64   `json:"sample_size"`
+			SamplePoints      int64   `json:"sample_points"`
+			SampledFiles      int64   `json:"sampled_files"`
+			SampledBytes      int64   `json:"sampled_bytes"`
+			SampledPercent    float64 `json:"sampled_percent"`
+		}{schedule.TotalSize, schedule.Files, schedule.SampleSize, schedule.SamplePoints, schedule.SampledFiles, schedule.SampledBytes, sampledPercent})
+	default:
+		fmt.Fprintf(out, "Total original size: %s\n", formatSize(schedule.TotalSize, args))
+		fmt.Fprintf(out, "Files scanned: %d\n", schedule.Files)
+		if schedule.SampleSize > 0 {
+			fmt.Fprintf(out, "Sample size: %s per sample point\n", formatSize(schedule.SampleSize, args))
 		}
-		if err != nil {
-			return compressedSize, err
+		fmt.Fprintf(out, "Sample points: %d, in %d files\n", schedule.SamplePoints, schedule.SampledFiles)
+		fmt.Fprintf(out, "Bytes to sample: %s (%.2f%% of the total)\n", formatSize(schedule.SampledBytes, args), sampledPercent)
+	}
+	return nil
+}
+
+// The name an extension is shown under; files without one are grouped as "(none)"
+func extensionName(extension string) string {
+	if extension == "" {
+		return "(none)"
+	}
+	return extension
+}
+
+// Print the estimate of each extension, largest first
+func printExtensionResults(extensions map[string]sizer.ExtensionResult, args Args) {
+	names := make([]string, 0, len(extensions))
+	for extension := range extensions {
+		names = append(names, extension)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if extensions[names[i]].TotalSize != extensions[names[j]].TotalSize {
+			return extensions[names[i]].TotalSize > extensions[names[j]].TotalSize
 		}
+		return names[i] < names[j]
+	})
+
+	fmt.Fprintf(out, "By extension:\n")
+	for _, extension := range names {
+		extensionResult := extensions[extension]
+		note := ""
+		if !extensionResult.Sampled {
+			note = ", not sampled"
+		}
+		fmt.Fprintf(out, "  %s: %s -> %s (ratio %.4f%s)\n",
+			extensionName(extension),
+			formatSize(extensionResult.TotalSize, args),
+			formatSize(extensionResult.EstimatedCompressedSize, args),
+			extensionResult.Ratio,
+			note,
+		)
+	}
+}
+
+// Print the per-file estimates, one line per file
+func printFileResults(fileResults []sizer.FileResult, args Args) {
+	for _, file := range fileResults {
+		fmt.Fprintf(out, "%s: %s -> %s (ratio %.4f)\n",
+			file.Path,
+			formatSize(file.TotalSize, args),
+			formatSize(file.EstimatedCompressedSize, args),
+			file.Ratio,
+		)
 	}
+}
 
-	return compressedSize / uncompressedSize, nil
+// The 95% confidence interval of an estimate; a compressed size cannot be negative
+func confidenceInterval(result sizer.Result) (int64, int64) {
+	return max(result.EstimatedCompressedSize-result.ConfidenceMargin, 0), result.EstimatedCompressedSize + result.ConfidenceMargin
 }
 
-// Validate the command line arguments
-func validateArgs(args Args) error {
-	if stat, err := os.Stat(args.Directory); err != nil || !stat.IsDir() {
-		fmt.Printf("Provided path '%s' is not a directory.\n", args.Directory)
-		os.Exit(1)
+// Add up the results of several directories into one
+// The directories are sampled independently, so their confidence margins add in quadrature
+func sumResults(results []sizer.Result) sizer.Result {
+	var total sizer.Result
+	total.HasConfidence = len(results) > 0
+	marginSquares := float64(0)
+	sampledEstimate := float64(0)
+	for _, result := range results {
+		total.HasConfidence = total.HasConfidence && result.HasConfidence
+		marginSquares += float64(result.ConfidenceMargin) * float64(result.ConfidenceMargin)
+		total.TotalSize += result.TotalSize
+		total.DiskSize += result.DiskSize
+		total.Files += result.Files
+		total.EstimatedCompressedSize += result.EstimatedCompressedSize
+		total.SampledBytes += result.SampledBytes
+		total.ActualCompressedSize += result.ActualCompressedSize
+		total.CompressedPortion += result.CompressedPortion
+		total.StoredPortion += result.StoredPortion
+		total.FilesBelowThreshold += result.FilesBelowThreshold
+		total.EncryptedFirstSize += result.EncryptedFirstSize
+		total.Partial = total.Partial || result.Partial
+		total.Elapsed += result.Elapsed
+		total.SampleRatio = max(total.SampleRatio, result.SampleRatio)
+		total.SampledUncompressedBytes += result.SampledUncompressedBytes
+		total.SampledCompressedBytes += result.SampledCompressedBytes
+		sampledEstimate += result.ScaleFactor * float64(result.SampledCompressedBytes)
+		total.LargestFiles = append(total.LargestFiles, result.LargestFiles...)
+		for extension, extensionResult := range result.Extensions {
+			if total.Extensions == nil {
+				total.Extensions = make(map[string]sizer.ExtensionResult)
+			}
+			extensionTotal := total.Extensions[extension]
+			extensionTotal.TotalSize += extensionResult.TotalSize
+			extensionTotal.EstimatedCompressedSize += extensionResult.EstimatedCompressedSize
+			extensionTotal.Sampled = extensionTotal.Sampled || extensionResult.Sampled
+			if extensionTotal.TotalSize > 0 {
+				extensionTotal.Ratio = float64(extensionTotal.EstimatedCompressedSize) / float64(extensionTotal.TotalSize)
+			}
+			total.Extensions[extension] = extensionTotal
+		}
+	}
+	if total.HasConfidence {
+		total.ConfidenceMargin = int64(math.Sqrt(marginSquares))
 	}
+	// The total's scale factor is the one that scales its compressed samples to the sum of the
+	// directories' scaled samples, so that the estimate can still be worked out from it
+	if total.SampledCompressedBytes > 0 {
+		total.ScaleFactor = sampledEstimate / float64(total.SampledCompressedBytes)
+	}
+	if total.TotalSize > 0 {
+		total.Ratio = float64(total.EstimatedCompressedSize) / float64(total.TotalSize)
+	}
+	return total
+}
 
-	// Check if the sample ratio is valid
-	if args.SampleRatio <= 0 || args.SampleRatio > 1 {
-		fmt.Printf("Sample ratio must be between 0 and 1.\n")
-		os.Exit(1)
+// Print every supported algorithm with the range of levels validateArgs accepts for it and
+// the level used when none is given
+func printAlgorithms() {
+	for _, algorithm := range sizer.CompressionAlgorithms {
+		if !sizer.HasCompressionLevels(algorithm) {
+			fmt.Printf("%s: no levels\n", algorithm)
+			continue
+		}
+		fmt.Printf("%s: levels %d-%d, default %d\n", algorithm, sizer.MinCompressionLevel(algorithm), sizer.MaxCompressionLevel(algorithm), sizer.DefaultCompressionLevel(algorithm))
+	}
+}
+
+// Warn on stderr when the estimate is scaled up from a tiny sample of the files, which makes it
+// little better than a guess
+// The fraction is taken of the files sampled, leaving out those whose ratio was assumed
+func warnIfSmallSample(result sizer.Result) {
+	if result.ScaleFactor <= 0 {
+		return
 	}
-	// Check if the compression level is valid
-	if args.CompressionLevel < 1 || args.CompressionLevel > 9 {
-		fmt.Printf("Compression level must be between 1 and 9.\n")
-		os.Exit(1)
+	if fraction := 1 / result.ScaleFactor; fraction < SMALL_SAMPLE_FRACTION {
+		sampledFrom := int64(float64(result.SampledUncompressedBytes) * result.ScaleFactor)
+		fmt.Fprintf(os.Stderr, "Warning: the estimate is scaled up from %d sampled bytes, only %.4f%% of the %d bytes they stand for; try a higher --sample-ratio.\n", result.SampledUncompressedBytes, fraction*100, sampledFrom)
 	}
-	// Check if the compression algorithm is valid
-	if args.CompressionAlgorithm != "gzip" && args.CompressionAlgorithm != "bzip2" {
-		fmt.Printf("Compression algorithm must be 'gzip' or 'bzip2'.\n")
-		os.Exit(1)
+}
+
+// The exit code of a run that estimated totalSize bytes: EXIT_NO_FILES when there was nothing
+// to estimate, because no files were found or all of them were empty
+func exitCode(totalSize int64) int {
+	if totalSize == 0 {
+		return EXIT_NO_FILES
 	}
+	return EXIT_OK
+}
 
-	return nil
+// Exit with EXIT_NO_FILES once the results are printed if there was no data to estimate
+func exitIfEmpty(totalSize int64) {
+	if code := exitCode(totalSize); code != EXIT_OK {
+		os.Exit(code)
+	}
 }
 
-// Convert bytes to human-readable format
-func convertToHumanReadable(size int64) string {
+// Parse the command line
+// A first argument naming a subcommand selects that mode and the flags it takes; without one
+// every flag may be given, as with scan
+func parseArgs(arguments []string) Args {
+	var args Args
+	defaults := sizer.DefaultOptions()
+	args.CompressionAlgorithm = defaults.CompressionAlgorithm
+	args.ChunkSize = ByteSize(defaults.ChunkSize)
+	args.Sampling = defaults.Sampling
+	args.Sort = defaults.Sort
+	args.Workers = defaults.Workers
+	args.Tolerance = defaults.Tolerance
+	args.MaxDepth = defaults.MaxDepth
+	args.MaxSampleMemory = ByteSize(defaults.MaxSampleMemory)
+	args.Output = "text"
+	// Flags that cannot be parsed are invalid arguments like any other
+	config := arg.Config{Out: os.Stdout, Exit: func(code int) {
+		if code != 0 {
+			code = EXIT_USAGE
+		}
+		os.Exit(code)
+	}}
+	if len(arguments) == 0 || !slices.Contains(subcommands, arguments[0]) {
+		mustParse(config, &args, arguments)
+		return args
+	}
 
-	sizeFloat := float64(size)
+	// Every subcommand starts from the same defaults
+	scan := args
+	commands := Commands{
+		Scan:    &scan,
+		Compare: &CompareArgs{CommonArgs: args.CommonArgs, Workers: args.Workers},
+		Sweep:   &SweepArgs{CommonArgs: args.CommonArgs, CompressionAlgorithm: args.CompressionAlgorithm, MaxSampleMemory: args.MaxSampleMemory},
+	}
+	mustParse(config, &commands, arguments)
+	switch arguments[0] {
+	case "compare":
+		args.CommonArgs = commands.Compare.CommonArgs
+		args.Level = commands.Compare.Level
+		args.Workers = commands.Compare.Workers
+		args.Compare = true
+	case "sweep":
+		args.CommonArgs = commands.Sweep.CommonArgs
+		args.CompressionAlgorithm = commands.Sweep.CompressionAlgorithm
+		args.MaxSampleMemory = commands.Sweep.MaxSampleMemory
+		args.Sweep = true
+	default:
+		args = scan
+	}
+	return args
+}
 
-	units := []string{"B", "KB", "MB", "GB", "TB"}
-	index := 0
-	for sizeFloat >= 1024 && index < len(units)-1 {
-		sizeFloat /= 1024
-		index++
+// Parse the arguments into dest, exiting on a usage error
+func mustParse(config arg.Config, dest interface{}, arguments []string) {
+	parser, err := arg.NewParser(config, dest)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(EXIT_USAGE)
 	}
-	return fmt.Sprintf("%.2f %s", float64(sizeFloat), units[index])
+	parser.MustParse(arguments)
+}
+
+// Settle the compression level and the sample ratio, which default to what the other flags imply
+func resolveLevelAndRatio(args Args) Args {
+	args.CompressionLevel = sizer.DefaultCompressionLevel(args.CompressionAlgorithm)
+	if args.Level != nil {
+		args.CompressionLevel = *args.Level
+	}
+	args.SampleRatio = Ratio(sizer.DefaultOptions().SampleRatio)
+	if args.Ratio != nil {
+		args.SampleRatio = *args.Ratio
+	} else if args.SampleSize > 0 && args.ChunkSize > 0 {
+		args.SampleRatio = Ratio(float64(args.SampleSize) / float64(args.ChunkSize))
+	}
+	return args
 }
 
 func main() {
-	var args Args
-	args.CompressionLevel = COMPRESSION_LEVEL
-	args.CompressionAlgorithm = "gzip"
-	args.SampleRatio = 0.1
-	arg.MustParse(&args)
+	args := resolveLevelAndRatio(parseArgs(os.Args[1:]))
+
+	// Listing the algorithms needs no directory
+	if args.ListAlgorithms {
+		printAlgorithms()
+		return
+	}
+
+	// A lone "-" in place of the directories reads the file list from stdin
+	if len(args.Directories) == 1 && args.Directories[0] == "-" && args.FilesFrom == "" {
+		args.FilesFrom = "-"
+		args.Directories = nil
+	}
+
+	// Resolve the directory arguments, which may be given as URLs or glob patterns
+	directories, err := expandDirectories(args.Directories, !args.NoGlob)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+	args.Directories = directories
 
 	// Validate the arguments
 	if err := validateArgs(args); err != nil {
-		fmt.Printf("Error validating arguments: %v\n", err)
-		os.Exit(1)
+		fmt.Printf("%v\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+	if args.Env {
+		args.Output = "env"
+	}
+	if args.NoRecursion {
+		args.MaxDepth = 0
+	}
+	if args.ShowConfig {
+		printConfig(os.Stderr, args)
 	}
 
-	// Calculate the sample size based on the sample ratio
-	sampleSize := int64(float64(CHUNKSIZE) * args.SampleRatio)
+	// bzip2 levels select a block size rather than a compression effort, so explain what the
+	// level means for users expecting gzip-like behavior
+	if args.Verbose && args.CompressionAlgorithm == "bzip2" {
+		log.Printf("bzip2 level %d uses a %d KB block size; bzip2 ratios change little across levels", args.CompressionLevel, args.CompressionLevel*100)
+	}
 
-	// Create a channel to receive file sizes
-	fileInfoChan := make(chan FileInfo)
+	// Calibration replaces the normal run
+	if args.Calibrate {
+		passed, err := sizer.Calibrate(args.CompressionLevel, args.Verbose)
+		if err != nil {
+			fmt.Printf("Error during calibration: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		if !passed {
+			fmt.Printf("Calibration failed.\n")
+			os.Exit(EXIT_ERROR)
+		}
+		fmt.Printf("Calibration passed.\n")
+		return
+	}
 
-	// Start a goroutine to list files and send their sizes to the channel
-	go listFilesWithSizes(args.Directory, fileInfoChan)
+	opts := sizer.Options{
+		CompressionLevel:     args.CompressionLevel,
+		CompressionAlgorithm: args.CompressionAlgorithm,
+		SampleRatio:          float64(args.SampleRatio),
+		SampleSize:           int64(args.SampleSize),
+		ChunkSize:            int64(args.ChunkSize),
+		Sampling:             args.Sampling,
+		Sort:                 args.Sort,
+		Workers:              args.Workers,
+		Verbose:              args.Verbose,
+		Adaptive:             args.Adaptive,
+		AdaptiveRatio:        args.AdaptiveRatio,
+		Tolerance:            args.Tolerance,
+		MaxSample:            args.MaxSample,
+		MaxSampleMemory:      int64(args.MaxSampleMemory),
+		ReadRetries:          args.ReadRetries,
+		Exclude:              args.Exclude,
+		ExcludeFullPath:      args.ExcludeFullPath,
+		MaxDepth:             args.MaxDepth,
+		FollowSymlinks:       args.FollowSymlinks,
+		ConcurrentWalk:       args.ConcurrentWalk,
+		OpenArchives:         args.OpenArchives,
+		Gitignore:            args.Gitignore,
+		MinSize:              int64(args.MinSize),
+		MaxSize:              int64(args.MaxSize),
+		Top:                  args.Top,
+		BlockSize:            int64(args.BlockSize),
+		Include:              sizer.ParseExtensions(args.Include),
+		Seed:                 args.Seed,
+		DeltaFilter:          args.DeltaFilter,
+		AgainstArchive:       args.AgainstArchive,
+		EncryptThenCompress:  args.EncryptThenCompress,
+		Breakdown:            args.Breakdown,
+		ByExtension:          args.ByExtension,
+		CompressThreshold:    int64(args.CompressThreshold),
+		Tar:                  args.Tar,
+		SkipCompressed:       args.SkipCompressed,
+		CacheDir:             args.CacheDir,
+		SizeIndex:            args.SizeIndex,
+		FilesFrom:            args.FilesFrom,
+		Create:               args.Create,
+		UseLearned:           args.UseLearned,
+	}
+	if args.Progress {
+		opts.Progress = os.Stderr
+	}
+	if !args.Quiet {
+		opts.Errors = os.Stderr
+	}
+	if args.OutFile != "" {
+		outFile, err := os.Create(args.OutFile)
+		if err != nil {
+			fmt.Printf("Error creating output file: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		defer outFile.Close()
+		out = outFile
+	}
+	if args.DumpSample != "" {
+		dumpFile, err := os.Create(args.DumpSample)
+		if err != nil {
+			fmt.Printf("Error creating sample dump: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		defer dumpFile.Close()
+		opts.DumpSample = dumpFile
+	}
 
-	// Stream the sampled data from the files
-	sampledData, err := streamSampledData(fileInfoChan, CHUNKSIZE, sampleSize, args.Verbose)
-	if err != nil {
-		fmt.Printf("Error streaming sampled data: %v\n", err)
-		os.Exit(1)
+	// Compile the exclude regexes once, rather than for every path in the walk
+	for _, pattern := range args.ExcludeRegex {
+		opts.ExcludeRegex = append(opts.ExcludeRegex, regexp.MustCompile(pattern))
 	}
 
-	// Compress the sampled data and calculate the compression ratio
-	compressedRatio, err := compressData(
-		sampledData,
-		args.CompressionLevel,
-		args.CompressionAlgorithm,
-	)
-	if err != nil {
-		fmt.Printf("Error during compression: %v\n", err)
-		os.Exit(1)
+	// Load the explicit sampling plan
+	if args.SamplePlan != "" {
+		opts.SamplePlan, err = sizer.LoadSamplePlan(args.SamplePlan)
+		if err != nil {
+			fmt.Printf("Error loading sample plan: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+	}
+
+	// Load the learned ratios for these settings
+	var learnedStore map[string]map[string]sizer.LearnedRatio
+	if args.Learn != "" {
+		learnedStore, err = sizer.LoadLearnedRatios(args.Learn)
+		if err != nil {
+			fmt.Printf("Error loading learned ratios: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		learnedKey := sizer.LearnedRatioKey(args.CompressionLevel, args.CompressionAlgorithm)
+		if learnedStore[learnedKey] == nil {
+			learnedStore[learnedKey] = make(map[string]sizer.LearnedRatio)
+		}
+		opts.Learned = learnedStore[learnedKey]
+	}
+
+	// A list with a leading + extends the built-in compressed extensions instead of replacing them
+	if args.CompressedExt != "" {
+		if list, ok := strings.CutPrefix(args.CompressedExt, "+"); ok {
+			opts.CompressedExtensions = append(slices.Clone(sizer.CompressedExtensions), sizer.ParseExtensions(list)...)
+		} else {
+			opts.CompressedExtensions = append([]string{}, sizer.ParseExtensions(list)...)
+		}
+	}
+
+	// Load the preset dictionary
+	if args.Dictionary != "" {
+		opts.Dictionary, err = os.ReadFile(args.Dictionary)
+		if err != nil {
+			fmt.Printf("Error reading dictionary: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+	}
+
+	// Load the path hints
+	if args.Hints != "" {
+		opts.Hints, err = sizer.LoadHints(args.Hints)
+		if err != nil {
+			fmt.Printf("Error loading hints: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+	}
+
+	// The paths in a size index or file list are relative to the current directory, which
+	// stands in for the directory argument from here on
+	if args.SizeIndex != "" || args.FilesFrom != "" {
+		args.Directories = []string{"."}
+	}
+
+	// Show what would be sampled and stop there; directories estimated separately are
+	// sampled separately, so their schedules are added up
+	if args.DryRun {
+		var schedule sizer.SampleSchedule
+		if args.Combined || args.Compare {
+			schedule, err = sizer.PlanSamples(args.Directories, opts)
+		} else {
+			for _, directory := range args.Directories {
+				directorySchedule, directoryErr := sizer.PlanSamples([]string{directory}, opts)
+				if directoryErr != nil {
+					err = directoryErr
+					break
+				}
+				schedule.TotalSize += directorySchedule.TotalSize
+				schedule.Files += directorySchedule.Files
+				schedule.SampleSize = directorySchedule.SampleSize
+				schedule.SamplePoints += directorySchedule.SamplePoints
+				schedule.SampledFiles += directorySchedule.SampledFiles
+				schedule.SampledBytes += directorySchedule.SampledBytes
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error planning samples: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		if err := printSchedule(schedule, args); err != nil {
+			fmt.Printf("Error writing JSON: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		exitIfEmpty(schedule.TotalSize)
+		return
+	}
+
+	// Try every level of the algorithm on the same samples, with all directories as one stream
+	if args.Sweep {
+		results, err := sizer.SweepLevels(args.Directories, opts)
+		if err != nil {
+			fmt.Printf("Error estimating: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		if err := printSweep(results, args); err != nil {
+			fmt.Printf("Error writing JSON: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		exitIfEmpty(results[0].TotalSize)
+		return
 	}
 
-	// Calculate the estimated compressed size based on the total size and compression ratio
-	estimatedCompressedSize := int64(float64(totalSize) * compressedRatio)
-	if args.HumanReadable {
-		fmt.Printf("Total original size: %s\n", convertToHumanReadable(totalSize))
-		fmt.Printf("Estimated compressed size: %s\n", convertToHumanReadable(estimatedCompressedSize))
+	// Time compressing the samples, with all directories as one stream
+	if args.Repeat > 0 {
+		algorithms := []string{args.CompressionAlgorithm}
+		if args.Compare {
+			algorithms = nil
+			for _, algorithm := range sizer.CompressionAlgorithms {
+				if args.CompressionLevel >= sizer.MinCompressionLevel(algorithm) && args.CompressionLevel <= sizer.MaxCompressionLevel(algorithm) {
+					algorithms = append(algorithms, algorithm)
+				}
+			}
+		}
+		results, err := sizer.Benchmark(args.Directories, opts, algorithms, args.Repeat)
+		if err != nil {
+			fmt.Printf("Error estimating: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		if err := printBenchmark(results, args); err != nil {
+			fmt.Printf("Error writing JSON: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		exitIfEmpty(results[algorithms[0]].TotalSize)
+		return
+	}
+
+	// Compare the algorithms on the same samples, with all directories as one stream
+	if args.Compare {
+		results, err := sizer.CompareAlgorithms(args.Directories, opts)
+		if err != nil {
+			fmt.Printf("Error estimating: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		if err := printComparison(results, args); err != nil {
+			fmt.Printf("Error writing JSON: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		// Every algorithm was given the same files
+		for _, result := range results {
+			exitIfEmpty(result.TotalSize)
+			break
+		}
+		return
+	}
+
+	// Estimate every file on its own, listing the files that would save the most space first
+	// The totals are the sum of the per-file estimates
+	if args.PerFile && args.Output == "ndjson" {
+		// Every estimate is written as a line of its own as soon as it is made, unsorted, so
+		// that nothing is held in memory
+		encoder := json.NewEncoder(out)
+		totalSize := int64(0)
+		for _, directory := range args.Directories {
+			err := sizer.EstimateFilesFunc(directory, opts, func(file sizer.FileResult) error {
+				totalSize += file.TotalSize
+				return encoder.Encode(file)
+			})
+			if err != nil {
+				fmt.Printf("Error estimating '%s': %v\n", directory, err)
+				os.Exit(EXIT_ERROR)
+			}
+		}
+		exitIfEmpty(totalSize)
+		return
+	}
+	if args.PerFile {
+		start := time.Now()
+		var fileResults []sizer.FileResult
+		for _, directory := range args.Directories {
+			directoryResults, err := sizer.EstimateFiles(directory, opts)
+			if err != nil {
+				fmt.Printf("Error estimating '%s': %v\n", directory, err)
+				os.Exit(EXIT_ERROR)
+			}
+			fileResults = append(fileResults, directoryResults...)
+		}
+		sort.SliceStable(fileResults, func(i, j int) bool {
+			return fileResults[i].TotalSize-fileResults[i].EstimatedCompressedSize > fileResults[j].TotalSize-fileResults[j].EstimatedCompressedSize
+		})
+
+		total := sizer.Result{Files: int64(len(fileResults)), Elapsed: time.Since(start)}
+		for _, file := range fileResults {
+			total.TotalSize += file.TotalSize
+			total.EstimatedCompressedSize += file.EstimatedCompressedSize
+			if file.TotalSize < int64(args.CompressThreshold) {
+				total.FilesBelowThreshold++
+			}
+		}
+		if total.TotalSize > 0 {
+			total.Ratio = float64(total.EstimatedCompressedSize) / float64(total.TotalSize)
+		}
+
+		switch args.Output {
+		case "env":
+			printEnvResult(total, args)
+		case "json":
+			encoder := json.NewEncoder(out)
+			encoder.SetIndent("", "  ")
+			if fileResults == nil {
+				fileResults = []sizer.FileResult{}
+			}
+			if err := encoder.Encode(fileResults); err != nil {
+				fmt.Printf("Error writing JSON: %v\n", err)
+				os.Exit(EXIT_ERROR)
+			}
+		case "csv":
+			if err := printCSV(fileResults); err != nil {
+				fmt.Printf("Error writing CSV: %v\n", err)
+				os.Exit(EXIT_ERROR)
+			}
+		default:
+			printFileResults(fileResults, args)
+			fmt.Fprintln(out)
+			printTextResult(total, args)
+		}
+		exitIfEmpty(total.TotalSize)
+		return
+	}
+
+	// Ctrl-C stops the scan, and what was sampled by then is still estimated; a second Ctrl-C
+	// exits at once. The timeout covers the estimates of all the directories together
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	interrupted := ctx
+	go func() {
+		<-interrupted.Done()
+		stop()
+	}()
+	if args.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, args.Timeout)
+		defer cancel()
+	}
+
+	// Estimate each directory in turn, or all of them as one stream when combined
+	results := make([]sizer.Result, 0, len(args.Directories))
+	if args.Combined {
+		result, err := sizer.EstimateDirectoriesContext(ctx, args.Directories, opts)
+		if err != nil {
+			fmt.Printf("Error estimating: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		results = append(results, result)
 	} else {
-		fmt.Printf("Total original size: %d bytes\n", totalSize)
-		fmt.Printf("Estimated compressed size: %d bytes\n", estimatedCompressedSize)
+		for _, directory := range args.Directories {
+			result, err := sizer.EstimateDirectoriesContext(ctx, []string{directory}, opts)
+			if err != nil {
+				fmt.Printf("Error estimating '%s': %v\n", directory, err)
+				os.Exit(EXIT_ERROR)
+			}
+			results = append(results, result)
+		}
+	}
+
+	stopReason = "the scan was interrupted"
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		stopReason = fmt.Sprintf("the scan timed out after %s", args.Timeout)
+	}
+
+	if learnedStore != nil {
+		if err := sizer.SaveLearnedRatios(args.Learn, learnedStore); err != nil {
+			fmt.Printf("Error saving learned ratios: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+	}
+	warnIfSmallSample(sumResults(results))
+
+	// Shell variables describe the combined result only, while JSON also lists each directory
+	// and CSV has a row for each, or a single one for the directories combined
+	switch args.Output {
+	case "env":
+		printEnvResult(sumResults(results), args)
+	case "json":
+		if err := printJSONResult(results, args); err != nil {
+			fmt.Printf("Error writing JSON: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+	case "csv":
+		var rows []sizer.FileResult
+		for i, result := range results {
+			path := strings.Join(args.Directories, " ")
+			if !args.Combined {
+				path = args.Directories[i]
+			}
+			rows = append(rows, sizer.FileResult{Path: path, TotalSize: result.TotalSize, EstimatedCompressedSize: result.EstimatedCompressedSize, Ratio: result.Ratio})
+		}
+		if err := printCSV(rows); err != nil {
+			fmt.Printf("Error writing CSV: %v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+	case "prometheus":
+		printPrometheus(results, args)
+	default:
+		// A single directory gets the plain report; several get one report each plus a total
+		if len(results) == 1 {
+			printTextResult(results[0], args)
+			break
+		}
+		for i, result := range results {
+			fmt.Fprintf(out, "Directory: %s\n", args.Directories[i])
+			printTextResult(result, args)
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "All %d directories:\n", len(results))
+		printTextResult(sumResults(results), args)
 	}
+	exitIfEmpty(sumResults(results).TotalSize)
 }
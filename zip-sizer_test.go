@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	"github.com/arunsupe/zip-sizer/sizer"
+)
+
+func TestConvertToHumanReadable(t *testing.T) {
+	tests := []struct {
+		size    int64
+		decimal bool
+		want    string
+	}{
+		{0, false, "0.00 B"},
+		{1023, false, "1023.00 B"},
+		{1024, false, "1.00 KiB"},
+		{1536, false, "1.50 KiB"},
+		{1<<20 - 1, false, "1024.00 KiB"},
+		{1 << 20, false, "1.00 MiB"},
+		{1 << 30, false, "1.00 GiB"},
+		{1 << 40, false, "1.00 TiB"},
+		{1 << 50, false, "1024.00 TiB"},
+		{999, true, "999.00 B"},
+		{1000, true, "1.00 KB"},
+		{1023, true, "1.02 KB"},
+		{1024, true, "1.02 KB"},
+		{1000000, true, "1.00 MB"},
+		{1000000000000, true, "1.00 TB"},
+	}
+	for _, test := range tests {
+		if got := convertToHumanReadable(test.size, test.decimal); got != test.want {
+			t.Errorf("convertToHumanReadable(%d, %v) = %q, want %q", test.size, test.decimal, got, test.want)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		text string
+		want int64
+	}{
+		{"0", 0},
+		{"4096", 4096},
+		{"1B", 1},
+		{"1K", 1024},
+		{"1KB", 1024},
+		{"1KiB", 1024},
+		{"512kb", 512 << 10},
+		{"1.5G", 3 << 29},
+		{"10MiB", 10 << 20},
+		{" 2 TB ", 2 << 40},
+	}
+	for _, test := range tests {
+		got, err := parseByteSize(test.text)
+		if err != nil || got != test.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", test.text, got, err, test.want)
+		}
+	}
+
+	for _, text := range []string{"", "MB", "-1", "1XB", "1.2.3K"} {
+		if got, err := parseByteSize(text); err == nil {
+			t.Errorf("parseByteSize(%q) = %d, want an error", text, got)
+		}
+	}
+}
+
+func TestHumanReadableSizesParseBack(t *testing.T) {
+	// The binary units --human-readable prints are the units sizes are given in
+	for _, size := range []int64{1, 1023, 1024, 3 << 19, 1 << 20, 5 << 30, 1 << 40} {
+		got, err := parseByteSize(convertToHumanReadable(size, false))
+		if err != nil || got != size {
+			t.Errorf("parseByteSize(convertToHumanReadable(%d)) = %d, %v", size, got, err)
+		}
+	}
+}
+
+func TestRatioUnmarshalText(t *testing.T) {
+	tests := []struct {
+		text string
+		want Ratio
+	}{
+		{"0.1", 0.1},
+		{"1", 1},
+		{"10%", 0.1},
+		{"2.5%", 0.025},
+		{" 50 % ", 0.5},
+		{"100%", 1},
+	}
+	for _, test := range tests {
+		var r Ratio
+		if err := r.UnmarshalText([]byte(test.text)); err != nil || r != test.want {
+			t.Errorf("UnmarshalText(%q) = %v, %v, want %v", test.text, r, err, test.want)
+		}
+	}
+
+	for _, text := range []string{"", "%", "ten", "0.1.2", "10%%"} {
+		var r Ratio
+		if err := r.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("UnmarshalText(%q) = %v, want an error", text, r)
+		}
+	}
+
+	// A ratio printed as it is shown with --show-config reads back as the same ratio
+	for _, ratio := range []Ratio{0.001, 0.1, 0.25, 1} {
+		var r Ratio
+		if err := r.UnmarshalText([]byte(fmt.Sprint(ratio))); err != nil || r != ratio {
+			t.Errorf("UnmarshalText(%q) = %v, %v, want %v", fmt.Sprint(ratio), r, err, ratio)
+		}
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"sub", "other"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("sub", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// DIR stands for a directory that exists; an empty want means the arguments are valid
+	tests := []struct {
+		arguments []string
+		want      string
+	}{
+		{[]string{"DIR"}, ""},
+		{[]string{"DIR", "DIR", "--combined", "-a", "zstd", "-l", "19"}, ""},
+		{[]string{file}, ""},
+		{[]string{}, "At least one directory is required"},
+		{[]string{filepath.Join(dir, "missing")}, "is not a directory or a regular file"},
+		{[]string{"DIR", "DIR", "--create", "out.tar.gz"}, "only be created from a single directory"},
+		{[]string{"DIR", "DIR"}, "counted twice in the total"},
+		{[]string{"DIR", "DIR/sub"}, "counted twice in the total"},
+		{[]string{"DIR/sub", "DIR/link"}, "counted twice in the total"},
+		{[]string{"DIR/sub", "DIR/other"}, ""},
+		{[]string{"DIR", "DIR/sub", "--combined"}, ""},
+		{[]string{"compare", "DIR", "DIR/sub"}, ""},
+		{[]string{"DIR", "--sample-size", "1KB", "--sample-ratio", "0.1"}, "mutually exclusive"},
+		{[]string{"DIR", "--sample-size", "2MB", "-c", "1MB"}, "at most the chunk size"},
+		{[]string{"DIR", "-r", "0"}, "Sample ratio must be between 0 and 1"},
+		{[]string{"DIR", "-r", "150%"}, "Sample ratio must be between 0 and 1"},
+		{[]string{"DIR", "-r", "0.001", "-c", "512"}, "Increase --sample-ratio or --chunk-size"},
+		{[]string{"DIR", "-r", "0.0000001"}, "Increase --sample-ratio or --chunk-size"},
+		{[]string{"DIR", "--sample-size", "10"}, "Increase --sample-size"},
+		{[]string{"DIR", "--sample-size", "64"}, ""},
+		{[]string{"DIR", "--min-size", "2MB", "--max-size", "1MB"}, "cannot be less than the minimum"},
+		{[]string{"DIR", "--no-recursion", "--max-depth", "2"}, "--no-recursion cannot be combined with --max-depth"},
+		{[]string{"DIR", "-a", "lzma"}, "Compression algorithm must be one of"},
+		{[]string{"DIR", "-l", "10"}, "between 0 and 9 for gzip"},
+		{[]string{"DIR", "-a", "zstd", "-l", "0"}, "for zstd"},
+		{[]string{"DIR", "-a", "gzip", "-l", "0"}, ""},
+		{[]string{"DIR", "-a", "bzip2", "-l", "0"}, "between 1 and 9 for bzip2"},
+		{[]string{"DIR", "--per-file", "--breakdown"}, "Per-file estimates cannot be combined"},
+		{[]string{"DIR", "--adaptive-ratio", "--adaptive"}, "An adaptive sample ratio cannot be combined"},
+		{[]string{"DIR", "--use-learned"}, "requires --learn"},
+		{[]string{"DIR", "--compressed-ext", ".foo"}, "requires --skip-compressed"},
+		{[]string{"DIR", "-o", "yaml"}, "Output format must be one of"},
+		{[]string{"DIR", "-o", "ndjson"}, "NDJSON output requires --per-file"},
+		{[]string{"DIR", "--env", "-o", "json"}, "--env cannot be combined with --output json"},
+		{[]string{"DIR", "--exclude-regex", "("}, "Invalid exclude regex"},
+		{[]string{"DIR", "--files-from", file}, "cannot be combined with directories"},
+		{[]string{"--size-index", filepath.Join(dir, "missing")}, "Cannot read size index"},
+		{[]string{"DIR", "--sampling", "stratified", "--delta-filter"}, "Stratified and contiguous sampling cannot be combined"},
+		// The modes --compare and --sweep select, whether given as flags or as subcommands
+		{[]string{"DIR", "--compare", "--per-file"}, "Comparing algorithms cannot be combined"},
+		{[]string{"DIR", "--sweep", "--repeat", "3"}, "A level sweep cannot be combined"},
+		{[]string{"DIR", "--sweep", "-l", "5"}, "cannot be combined with --compression-level or snappy"},
+		{[]string{"compare", "DIR", "-j", "4"}, ""},
+		{[]string{"compare", "DIR", "-o", "csv"}, "CSV output cannot be combined"},
+		{[]string{"compare", "DIR", "-o", "prometheus"}, "Prometheus output cannot be combined"},
+		{[]string{"sweep", "DIR", "-a", "zstd"}, ""},
+		{[]string{"sweep", "DIR", "-a", "snappy"}, "cannot be combined with --compression-level or snappy"},
+		{[]string{"sweep", "DIR", "--timing"}, "Timing cannot be combined"},
+		{[]string{"scan", "DIR", "--per-file", "-o", "ndjson"}, ""},
+	}
+	for _, test := range tests {
+		arguments := make([]string, len(test.arguments))
+		for i, argument := range test.arguments {
+			arguments[i] = strings.ReplaceAll(argument, "DIR", dir)
+		}
+		err := validateArgs(resolveLevelAndRatio(parseArgs(arguments)))
+		if test.want == "" && err != nil {
+			t.Errorf("%v: %v", test.arguments, err)
+		} else if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%v: got %v, want an error containing %q", test.arguments, err, test.want)
+		}
+	}
+}
+
+func TestSubcommandFlags(t *testing.T) {
+	// Flags outside a subcommand's mode are not flags of it at all, so the parser rejects them
+	tests := []struct {
+		arguments []string
+		valid     bool
+	}{
+		{[]string{"compare", "dir", "-l", "5", "-j", "2", "--sampling", "stratified"}, true},
+		{[]string{"compare", "dir", "--per-file"}, false},
+		{[]string{"compare", "dir", "-a", "zstd"}, false},
+		{[]string{"compare", "dir", "--sweep"}, false},
+		{[]string{"sweep", "dir", "-a", "xz", "--max-sample-memory", "1MB"}, true},
+		{[]string{"sweep", "dir", "-l", "5"}, false},
+		{[]string{"sweep", "dir", "-j", "4"}, false},
+		{[]string{"sweep", "dir", "--compare"}, false},
+		{[]string{"scan", "dir", "--per-file", "-a", "zstd", "-l", "3"}, true},
+	}
+	for _, test := range tests {
+		var commands Commands
+		parser, err := arg.NewParser(arg.Config{}, &commands)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := parser.Parse(test.arguments); (err == nil) != test.valid {
+			t.Errorf("%v: parsing gave %v, want valid %v", test.arguments, err, test.valid)
+		}
+	}
+}
+
+// Capture what a printer writes to out
+func captureOutput(t *testing.T, print func() error) string {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := out
+	out = &buf
+	defer func() { out = saved }()
+	if err := print(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// Two directories estimated with gzip at level 6, the second stopped before all its files were listed
+var printedResults = []sizer.Result{
+	{TotalSize: 1000, Files: 4, EstimatedCompressedSize: 250, Ratio: 0.25, SampledUncompressedBytes: 100, SampledCompressedBytes: 25, ScaleFactor: 10, ConfidenceMargin: 30, HasConfidence: true, Elapsed: 1500 * time.Millisecond},
+	{TotalSize: 3000, Files: 2, EstimatedCompressedSize: 2990, Ratio: 2990.0 / 3000, Partial: true, Elapsed: 250 * time.Millisecond},
+}
+
+func printedArgs() Args {
+	args := resolveLevelAndRatio(parseArgs([]string{"-l", "6", "data"}))
+	// A directory name holding every character a label has to escape
+	args.Directories = []string{"/srv/data", "/srv/odd \\ \"name\"\nline"}
+	return args
+}
+
+func TestPrintPrometheus(t *testing.T) {
+	args := printedArgs()
+	args.Timing = true
+	got := captureOutput(t, func() error { printPrometheus(printedResults, args); return nil })
+	want := `# HELP zipsizer_total_bytes Total size of the files estimated, in bytes.
+# TYPE zipsizer_total_bytes gauge
+zipsizer_total_bytes{directory="/srv/data",algorithm="gzip",level="6"} 1000
+zipsizer_total_bytes{directory="/srv/odd \\ \"name\"\nline",algorithm="gzip",level="6"} 3000
+# HELP zipsizer_estimated_bytes Estimated compressed size of the files, in bytes.
+# TYPE zipsizer_estimated_bytes gauge
+zipsizer_estimated_bytes{directory="/srv/data",algorithm="gzip",level="6"} 250
+zipsizer_estimated_bytes{directory="/srv/odd \\ \"name\"\nline",algorithm="gzip",level="6"} 2990
+# HELP zipsizer_ratio Estimated compressed size over total size.
+# TYPE zipsizer_ratio gauge
+zipsizer_ratio{directory="/srv/data",algorithm="gzip",level="6"} 0.25
+zipsizer_ratio{directory="/srv/odd \\ \"name\"\nline",algorithm="gzip",level="6"} 0.9966666666666667
+# HELP zipsizer_files Number of files estimated.
+# TYPE zipsizer_files gauge
+zipsizer_files{directory="/srv/data",algorithm="gzip",level="6"} 4
+zipsizer_files{directory="/srv/odd \\ \"name\"\nline",algorithm="gzip",level="6"} 2
+# HELP zipsizer_partial 1 if the scan was stopped before all the files were listed, 0 otherwise.
+# TYPE zipsizer_partial gauge
+zipsizer_partial{directory="/srv/data",algorithm="gzip",level="6"} 0
+zipsizer_partial{directory="/srv/odd \\ \"name\"\nline",algorithm="gzip",level="6"} 1
+# HELP zipsizer_elapsed_seconds Time taken by the estimate, in seconds.
+# TYPE zipsizer_elapsed_seconds gauge
+zipsizer_elapsed_seconds{directory="/srv/data",algorithm="gzip",level="6"} 1.5
+zipsizer_elapsed_seconds{directory="/srv/odd \\ \"name\"\nline",algorithm="gzip",level="6"} 0.25
+`
+	if got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+
+	// Combined directories are one sample labelled with all of them
+	args.Combined = true
+	args.Timing = false
+	got = captureOutput(t, func() error { printPrometheus([]sizer.Result{printedResults[0]}, args); return nil })
+	if !strings.Contains(got, `zipsizer_files{directory="/srv/data /srv/odd \\ \"name\"\nline",algorithm="gzip",level="6"} 4`+"\n") || strings.Contains(got, "elapsed") {
+		t.Errorf("printed\n%s", got)
+	}
+}
+
+func TestPrometheusLabel(t *testing.T) {
+	tests := []struct{ value, want string }{
+		{"plain", "plain"},
+		{`C:\dir`, `C:\\dir`},
+		{`say "hi"`, `say \"hi\"`},
+		{"two\nlines", `two\nlines`},
+		{`\"` + "\n", `\\\"\n`},
+		{"tab\tand unicode é", "tab\tand unicode é"},
+	}
+	for _, test := range tests {
+		if got := prometheusLabel(test.value); got != test.want {
+			t.Errorf("prometheusLabel(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestPrintCSV(t *testing.T) {
+	rows := []sizer.FileResult{
+		{Path: "/srv/data", TotalSize: 1000, EstimatedCompressedSize: 250, Ratio: 0.25},
+		{Path: `/srv/a,b "c"`, TotalSize: 3, EstimatedCompressedSize: 3, Ratio: 1},
+		{Path: "/srv/two\nlines", TotalSize: 3000, EstimatedCompressedSize: 2990, Ratio: 2990.0 / 3000},
+	}
+	got := captureOutput(t, func() error { return printCSV(rows) })
+	want := `path,original_size,estimated_size,ratio
+/srv/data,1000,250,0.250000
+"/srv/a,b ""c""",3,3,1.000000
+"/srv/two
+lines",3000,2990,0.996667
+`
+	if got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPrintEnvResult(t *testing.T) {
+	args := printedArgs()
+	got := captureOutput(t, func() error { printEnvResult(printedResults[0], args); return nil })
+	want := `ZIPSIZER_ORIGINAL=1000
+ZIPSIZER_FILES=4
+ZIPSIZER_ESTIMATED=250
+ZIPSIZER_RATIO=0.250000
+ZIPSIZER_SAVINGS=750
+ZIPSIZER_SAVINGS_PERCENT=75.00
+ZIPSIZER_CONFIDENCE_LOW=220
+ZIPSIZER_CONFIDENCE_HIGH=280
+`
+	if got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+
+	// The optional variables appear with the options that produce them
+	args.Timing = true
+	args.Breakdown = true
+	args.BlockSize = 4096
+	result := printedResults[1]
+	result.DiskSize = 8192
+	result.CompressedPortion, result.StoredPortion = 10, 2980
+	got = captureOutput(t, func() error { printEnvResult(result, args); return nil })
+	want = `ZIPSIZER_ORIGINAL=3000
+ZIPSIZER_DISK_SIZE=8192
+ZIPSIZER_FILES=2
+ZIPSIZER_ESTIMATED=2990
+ZIPSIZER_RATIO=0.996667
+ZIPSIZER_SAVINGS=10
+ZIPSIZER_SAVINGS_PERCENT=0.33
+ZIPSIZER_COMPRESSED_PORTION=10
+ZIPSIZER_STORED_PORTION=2980
+ZIPSIZER_PARTIAL=1
+ZIPSIZER_ELAPSED=0.250
+`
+	if got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPrintJSONResult(t *testing.T) {
+	args := printedArgs()
+	got := captureOutput(t, func() error { return printJSONResult(printedResults[:1], args) })
+	want := `{
+  "total_original_size": 1000,
+  "files": 4,
+  "estimated_compressed_size": 250,
+  "compression_ratio": 0.25,
+  "savings": 750,
+  "savings_percent": 75,
+  "algorithm": "gzip",
+  "level": 6,
+  "sample_ratio": 0.1,
+  "sampled_uncompressed_bytes": 100,
+  "sampled_compressed_bytes": 25,
+  "scale_factor": 10,
+  "confidence_low": 220,
+  "confidence_high": 280
+}
+`
+	if got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+
+	// Several directories are summed, and each is listed under its own name
+	got = captureOutput(t, func() error { return printJSONResult(printedResults, args) })
+	var printed jsonResult
+	if err := json.Unmarshal([]byte(got), &printed); err != nil {
+		t.Fatalf("printed invalid JSON %s: %v", got, err)
+	}
+	if printed.TotalOriginalSize != 4000 || printed.EstimatedCompressedSize != 3240 || printed.Files != 6 || !printed.Partial || len(printed.Directories) != 2 {
+		t.Errorf("printed %+v", printed)
+	}
+	for i, directory := range printed.Directories {
+		if directory.Directory != args.Directories[i] || directory.TotalOriginalSize != printedResults[i].TotalSize {
+			t.Errorf("directory %d printed as %+v", i, directory)
+		}
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	empty := t.TempDir()
+	emptyFiles := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(emptyFiles, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := printedArgs()
+	for _, dir := range []string{empty, emptyFiles} {
+		result, err := sizer.Estimate(dir, sizer.DefaultOptions())
+		if err != nil {
+			t.Fatalf("estimating %s: %v", dir, err)
+		}
+		got := captureOutput(t, func() error {
+			printTextResult(result, args)
+			printEnvResult(result, args)
+			return printJSONResult([]sizer.Result{result}, args)
+		})
+		if strings.Contains(got, "NaN") {
+			t.Errorf("the report on %s holds a NaN:\n%s", dir, got)
+		}
+		if code := exitCode(result.TotalSize); code != EXIT_NO_FILES {
+			t.Errorf("an estimate of %s exits with %d, want %d", dir, code, EXIT_NO_FILES)
+		}
+	}
+}